@@ -3,112 +3,170 @@ package main
 import (
 	"flag"
 	"fmt"
-	"github.com/thoj/go-ircevent" // imported as "irc"
-	"log"
 	"os"
+	"os/signal"
 	"strconv"
+	"sync"
+	"syscall"
 )
 
 func main() {
 	configfile := flag.String("config", "config.ini", "configuration file (lower priority if other flags are defined)")
-	logdest := flag.String("log", "", "destination (filename, stdout, stderr) of the log")
-	ircNick := flag.String("nick", "mress", "nickname")
-	ircPasswd := flag.String("passwd", "", "server/ident password")
-	ircServer := flag.String("server", "", "IRC server hostname")
-	ircPort := flag.Int("port", 6697, "IRC server port")
-	ircChannel := flag.String("channel", "", "IRC channel to join")
-	useTLS := flag.Bool("use-tls", true, "use TLS encrypted connection")
+	// settings read by loadConfig() if set
+	flag.String("log", "", "destination (filename, stdout, stderr) of the log")
+	flag.String("nick", "mress", "nickname")
+	flag.String("passwd", "", "server password (unless several networks are configured)")
+	flag.String("server", "", "IRC server hostname (unless several networks are configured)")
+	flag.Int("port", 6697, "IRC server port (unless several networks are configured)")
+	flag.String("channel", "", "IRC channels to join, comma separated (unless several networks are configured)")
+	flag.Bool("use-tls", true, "use TLS encrypted connection (all networks)")
 	debug := flag.Bool("debug", false, "enable debugging (+flags)")
-	offlineMsgDb := flag.String("offline-msg-db", "messages.db", "filename of sqlite3 database for offline messages")
+	flag.String("offline-msg-db", "messages.db", "filename of sqlite3 database for offline messages")
+	flag.String("offline-max-age", "", "time after which offline messages are removed, e.g. 30d (0 keeps them forever)")
+	flag.String("offline-keyfile", "", "file with keys to encrypt offline messages (current key first)")
+	reencrypt := flag.Bool("reencrypt", false, "encrypt all offline messages with the current key and exit")
+	flag.Int("max-retries", 0, "failed connection attempts in a row before giving up on a network (0 retries forever)")
+	flag.Int("offline-push-limit", defaultPushLimit, "number of offline messages delivered automatically (more are kept in the inbox)")
 	flag.Parse()
 
-	logchan := make(chan *log.Logger)
-	go getLogger(*logdest, *configfile, logchan)
-	logger := <-logchan
+	// load all settings at once, flags set on the commandline
+	// override the config file, which overrides the defaults.
+	// to use debugging should always be a conscious decision
+	// and is therefore not part of the config. TLS can only be
+	// disabled per network or for all networks by flag.
+	flags := make(map[string]string)
+	flag.Visit(func(f *flag.Flag) {
+		flags[f.Name] = f.Value.String()
+	})
+	config, errors := loadConfig(*configfile, flags)
+	if 0 < len(errors) {
+		for _, err := range errors {
+			fmt.Fprintln(os.Stderr, "config: "+err.Error())
+		}
+		os.Exit(1)
+	}
+	logger := createLogger(config.logDestination)
 	if nil == logger {
 		fmt.Fprint(os.Stderr, "creating logger failed")
 		os.Exit(1)
 	}
 
-	// determine config values concurrently with go-routines
-	// "fork" roughly according to need, choose non-default
-	// flags over config file values, collect config values
-	// later as needed
-	nickchan := make(chan string)
-	go getNick(*ircNick, *configfile, nickchan, logger)
-	passwdchan := make(chan string)
-	go getPassword(*ircPasswd, *configfile, passwdchan, logger)
-	servchan := make(chan string)
-	go getServer(*ircServer, *configfile, servchan, logger)
-	portchan := make(chan int)
-	go getPort(*ircPort, *configfile, portchan, logger)
-	chanchan := make(chan string)
-	go getChannel(*ircChannel, *configfile, chanchan, logger)
-	// to disable TLS and/or use debugging should always
-	// be conscious decisions and are therefore not part
-	// of the config.
-	offlinedbchan := make(chan string)
-	go getOfflineDBfilename(*offlineMsgDb, *configfile, offlinedbchan, logger)
-	// create IRC connection
-	nick := <-nickchan
-	irccon := irc.IRC(nick, "mress")
-	if nil == irccon {
-		logger.Println("creating IRC connection failed")
-	} else {
-		logger.Println("creating IRC connection worked")
+	// open storage shared by all features
+	db, err := openDatabase(config.dbfile)
+	if err != nil {
+		logger.Println("opening database failed")
+		logger.Println(err.Error())
+		os.Exit(3)
 	}
-	irccon.Password = <-passwdchan
-	if 0 < len(irccon.Password) {
-		logger.Println("password is used")
+	keys := config.keys
+	if *reencrypt {
+		count, err := reencryptDatabase(db, keys)
+		db.Close()
+		if err != nil {
+			logger.Println("re-encrypting offline messages failed")
+			logger.Println(err.Error())
+			os.Exit(3)
+		}
+		logger.Println("re-encrypted " + strconv.Itoa(count) + " offline messages")
+		os.Exit(0)
 	}
-	// configure IRC connection
-	if *useTLS {
-		irccon.UseTLS = true
-		logger.Println("using TLS encrypted connection")
+	if keys.enabled() {
+		logger.Println("offline messages are encrypted with key " + keys.current)
 	} else {
-		irccon.UseTLS = false
-		logger.Println("using cleartext connection")
-	}
-	if *debug {
-		irccon.Debug = true
+		logger.Println("offline messages are stored unencrypted")
 	}
-
-	// connect to server
-	socketstring := <-servchan + ":" + strconv.Itoa(<-portchan)
-	logger.Println("connecting to " + socketstring)
-	err := irccon.Connect(socketstring)
+	err = adoptLegacyMessages(db, config, logger)
 	if err != nil {
-		logger.Println("connecting to server failed")
+		logger.Println("moving messages of network " + defaultNetwork + " failed")
 		logger.Println(err.Error())
-		os.Exit(2)
+		db.Close()
+		os.Exit(3)
+	}
+	settings := config.offline
+	logger.Println("offline messages are scoped per " + settings.scope)
+	if 0 < settings.maxAge {
+		logger.Println("offline messages expire after " + settings.maxAge.String())
 	}
-	logger.Println("connecting to server succeeded")
-
-	// collect last config value needed
-	channel := <-chanchan
-	// add callbacks
-	irccon.AddCallback("001", func(e *irc.Event) {
-		logger.Println("joining " + channel)
-		irccon.Join(channel)
-	})
 
-	offlmsgdb := <-offlinedbchan
-	irccon.AddCallback("001", func(e *irc.Event) {
-		err := initOfflineMessageDatabase(offlmsgdb)
+	// set up all networks before connecting to any,
+	// report all broken ones
+	networks := []*ircNetwork{}
+	broken := false
+	for _, netconfig := range config.networks {
+		network, err := newNetwork(netconfig, db, keys, settings, *debug, logger)
 		if err != nil {
+			logger.Println("setting up network " + netconfig.name + " failed")
 			logger.Println(err.Error())
+			fmt.Fprintln(os.Stderr, "network "+netconfig.name+": "+err.Error())
+			broken = true
+			continue
 		}
-	})
-	irccon.AddCallback("PRIVMSG", func(e *irc.Event) {
-		offlineMessengerCommand(e, irccon, nick, offlmsgdb, logger)
-	})
-	irccon.AddCallback("JOIN", func(e *irc.Event) {
-		offlineMessengerDrone(e, irccon, offlmsgdb, nick, channel, logger)
-	})
-	irccon.AddCallback("353", func(e *irc.Event) {
-		offlineMessengerDrone(e, irccon, offlmsgdb, nick, channel, logger)
-	})
+		networks = append(networks, network)
+	}
+	if broken {
+		for _, network := range networks {
+			network.store.close()
+		}
+		db.Close()
+		os.Exit(3)
+	}
+
+	// quit cleanly on SIGINT and SIGTERM
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		sig := <-signals
+		logger.Println("received " + sig.String() + ", quitting")
+		for _, network := range networks {
+			network.quit()
+		}
+	}()
+
+	// reload the config on SIGHUP, apply what can be applied live
+	hangups := make(chan os.Signal, 1)
+	signal.Notify(hangups, syscall.SIGHUP)
+	go func() {
+		for range hangups {
+			logger.Println("received SIGHUP, reloading " + config.file)
+			reloaded, errors := loadConfig(config.file, flags)
+			if 0 < len(errors) {
+				for _, err := range errors {
+					logger.Println(err.Error())
+				}
+				logger.Println("reloading failed, keeping the running config")
+				continue
+			}
+			config = applyConfig(config, reloaded, networks, logger)
+		}
+	}()
 
-	logger.Println("starting event loop")
-	irccon.Loop()
+	// keep all networks connected until quitting
+	var running sync.WaitGroup
+	failed := make(chan string, len(networks))
+	for _, network := range networks {
+		running.Add(1)
+		go func(network *ircNetwork) {
+			defer running.Done()
+			err := network.run()
+			if err != nil {
+				network.logger.Println(err.Error())
+				failed <- network.config.name
+			}
+		}(network)
+	}
+	running.Wait()
+	close(failed)
+	gaveUp := 0
+	for range failed {
+		gaveUp++
+	}
+
+	logger.Println("closing database")
+	err = db.Close()
+	if err != nil {
+		logger.Println(err.Error())
+	}
+	if 0 < gaveUp {
+		os.Exit(2)
+	}
 }
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"math/rand"
+	"time"
+)
+
+// Delays between reconnection attempts unless configured otherwise.
+const (
+	defaultReconnectDelay    = 2 * time.Second
+	defaultMaxReconnectDelay = 5 * time.Minute
+)
+
+// Exponential backoff with jitter: every attempt doubles the delay up
+// to max, the actual delay is picked at random from the upper half so
+// several connections don't retry in lockstep. Not safe for concurrent
+// use.
+type backoff struct {
+	initial time.Duration
+	max     time.Duration
+	attempt uint
+	random  *rand.Rand
+}
+
+// Create a backoff starting with initial and growing up to max.
+func newBackoff(initial, max time.Duration) *backoff {
+	return &backoff{
+		initial: initial,
+		max:     max,
+		random:  rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+// Delay before the next attempt.
+func (b *backoff) next() time.Duration {
+	delay := b.initial
+	for i := uint(0); i < b.attempt && delay < b.max; i++ {
+		delay *= 2
+	}
+	if delay > b.max {
+		delay = b.max
+	}
+	b.attempt++
+	half := delay / 2
+	if half <= 0 {
+		return delay
+	}
+	return half + time.Duration(b.random.Int63n(int64(half)+1))
+}
+
+// Start over with the initial delay, e.g. after a connection worked.
+func (b *backoff) reset() {
+	b.attempt = 0
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// delays double up to the maximum, with jitter in the upper half
+func Test_backoff_next_0(t *testing.T) {
+	t.Parallel()
+	b := newBackoff(time.Second, 10*time.Second)
+	for _, expected := range []time.Duration{1, 2, 4, 8, 10, 10} {
+		delay := b.next()
+		if delay < expected*time.Second/2 || delay > expected*time.Second {
+			t.Error("delay " + delay.String() + " out of range for " + (expected * time.Second).String())
+		}
+	}
+	b.reset()
+	if delay := b.next(); delay > time.Second {
+		t.Error("reset did not start over")
+	}
+}
+
+// no overflow after many attempts
+func Test_backoff_next_1(t *testing.T) {
+	t.Parallel()
+	b := newBackoff(time.Second, time.Minute)
+	for i := 0; i < 100; i++ {
+		if delay := b.next(); delay <= 0 || delay > time.Minute {
+			t.Fatal("delay " + delay.String() + " out of range")
+		}
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"fmt"
+	"github.com/thoj/go-ircevent" // imported as "irc"
+	"strings"
+	"sync"
+)
+
+// Rules for comparing nicks and channel names case insensitively,
+// as advertised by the server (CASEMAPPING in RPL_ISUPPORT).
+type caseMapping int
+
+const (
+	// A-Z, []\~ are the upper case of a-z, {}|^ (default per RFC 2812)
+	rfc1459Mapping caseMapping = iota
+	// A-Z, []\ are the upper case of a-z, {}|
+	strictRFC1459Mapping
+	// only A-Z are the upper case of a-z
+	asciiMapping
+)
+
+// Look up a casemapping by the name used in RPL_ISUPPORT.
+func parseCaseMapping(name string) (caseMapping, error) {
+	switch strings.ToLower(name) {
+	case "rfc1459":
+		return rfc1459Mapping, nil
+	case "strict-rfc1459":
+		return strictRFC1459Mapping, nil
+	case "ascii":
+		return asciiMapping, nil
+	}
+	return rfc1459Mapping, fmt.Errorf("unknown casemapping " + name)
+}
+
+// Name of the casemapping as used in RPL_ISUPPORT.
+func (m caseMapping) String() string {
+	switch m {
+	case strictRFC1459Mapping:
+		return "strict-rfc1459"
+	case asciiMapping:
+		return "ascii"
+	}
+	return "rfc1459"
+}
+
+// Map a nick (or channel name) to its lower case form, so equal
+// nicks have equal folded forms.
+func (m caseMapping) fold(nick string) string {
+	folded := []byte(nick)
+	for i, c := range folded {
+		switch {
+		case 'A' <= c && c <= 'Z':
+			folded[i] = c + ('a' - 'A')
+		case asciiMapping == m:
+		case '[' == c:
+			folded[i] = '{'
+		case ']' == c:
+			folded[i] = '}'
+		case '\\' == c:
+			folded[i] = '|'
+		case '~' == c && rfc1459Mapping == m:
+			folded[i] = '^'
+		}
+	}
+	return string(folded)
+}
+
+// Compares nicks according to the casemapping of the server connected
+// to. Shared by all features keyed by nick. Safe for concurrent use,
+// a nil nickMapper uses the RFC 2812 default.
+type nickMapper struct {
+	mutex   sync.RWMutex
+	current caseMapping
+}
+
+// Create a nickMapper using the default casemapping until the server
+// advertises its own.
+func newNickMapper() *nickMapper {
+	return &nickMapper{current: rfc1459Mapping}
+}
+
+// The casemapping currently used.
+func (n *nickMapper) mapping() caseMapping {
+	if n == nil {
+		return rfc1459Mapping
+	}
+	n.mutex.RLock()
+	defer n.mutex.RUnlock()
+	return n.current
+}
+
+// Map a nick to its lower case form under the current casemapping.
+func (n *nickMapper) fold(nick string) string {
+	return n.mapping().fold(nick)
+}
+
+// Report if two nicks (or channel names) are equal under the current
+// casemapping.
+func (n *nickMapper) equal(a, b string) bool {
+	mapping := n.mapping()
+	return mapping.fold(a) == mapping.fold(b)
+}
+
+// Pick up the casemapping from RPL_ISUPPORT. To be used as a callback
+// for 005. Reports if the casemapping changed.
+// 005 mress CHANTYPES=# CASEMAPPING=ascii NICKLEN=16 :are supported by this server
+func (n *nickMapper) handleISupport(e *irc.Event) (bool, error) {
+	if n == nil {
+		return false, fmt.Errorf("nick mapper is nil")
+	}
+	if e == nil || "005" != e.Code {
+		return false, nil
+	}
+	for _, token := range e.Arguments {
+		if !strings.HasPrefix(token, "CASEMAPPING=") {
+			continue
+		}
+		mapping, err := parseCaseMapping(strings.TrimPrefix(token, "CASEMAPPING="))
+		if err != nil {
+			return false, err
+		}
+		n.mutex.Lock()
+		defer n.mutex.Unlock()
+		changed := mapping != n.current
+		n.current = mapping
+		return changed, nil
+	}
+	return false, nil
+}
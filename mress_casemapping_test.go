@@ -0,0 +1,80 @@
+package main
+
+import (
+	"github.com/thoj/go-ircevent"
+	"testing"
+)
+
+func Test_parseCaseMapping_0(t *testing.T) {
+	t.Parallel()
+	for _, name := range []string{"rfc1459", "strict-rfc1459", "ascii"} {
+		mapping, err := parseCaseMapping(name)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if name != mapping.String() {
+			t.Error("wrong casemapping for " + name)
+		}
+	}
+	_, err := parseCaseMapping("rfc7613")
+	if err == nil {
+		t.Error("unknown casemapping not detected")
+	}
+}
+
+func Test_caseMapping_fold_0(t *testing.T) {
+	t.Parallel()
+	nick := "Bob[A]\\x~"
+	if "bob{a}|x^" != rfc1459Mapping.fold(nick) {
+		t.Error("wrong rfc1459 folding: " + rfc1459Mapping.fold(nick))
+	}
+	if "bob{a}|x~" != strictRFC1459Mapping.fold(nick) {
+		t.Error("wrong strict-rfc1459 folding: " + strictRFC1459Mapping.fold(nick))
+	}
+	if "bob[a]\\x~" != asciiMapping.fold(nick) {
+		t.Error("wrong ascii folding: " + asciiMapping.fold(nick))
+	}
+}
+
+func Test_nickMapper_0(t *testing.T) {
+	t.Parallel()
+	nicks := newNickMapper()
+	if !nicks.equal("Bob", "bOB") {
+		t.Error("nicks differing in case not equal")
+	}
+	if !nicks.equal("bob[m]", "BOB{M}") {
+		t.Error("rfc1459 not used by default")
+	}
+	var none *nickMapper
+	if !none.equal("bob[m]", "BOB{M}") {
+		t.Error("nil nick mapper not using rfc1459")
+	}
+}
+
+func Test_nickMapper_handleISupport_0(t *testing.T) {
+	t.Parallel()
+	nicks := newNickMapper()
+	event := &irc.Event{Code: "005", Arguments: []string{"mress", "CHANTYPES=#", "CASEMAPPING=ascii", "are supported by this server"}}
+	changed, err := nicks.handleISupport(event)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if !changed || asciiMapping != nicks.mapping() {
+		t.Error("casemapping not picked up")
+	}
+	if nicks.equal("bob[m]", "BOB{M}") {
+		t.Error("ascii casemapping not used")
+	}
+	changed, _ = nicks.handleISupport(event)
+	if changed {
+		t.Error("unchanged casemapping reported as change")
+	}
+	event = &irc.Event{Code: "005", Arguments: []string{"mress", "CASEMAPPING=unknown", "are supported by this server"}}
+	_, err = nicks.handleISupport(event)
+	if err == nil {
+		t.Error("unknown casemapping not detected")
+	}
+	if asciiMapping != nicks.mapping() {
+		t.Error("unknown casemapping changed mapping")
+	}
+}
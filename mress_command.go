@@ -0,0 +1,191 @@
+package main
+
+import (
+	"fmt"
+	"github.com/thoj/go-ircevent" // imported as "irc"
+	"log"
+	"sort"
+	"strings"
+)
+
+// A command sent to mress, either as a direct message ("tell ...")
+// or addressed to mress in a channel ("mress: tell ...").
+type command struct {
+	name    string     // command name (lower case), e.g. "tell"
+	args    string     // everything after the command name
+	nick    string     // nick of the sender
+	channel string     // channel of the command, empty for direct messages
+	event   *irc.Event // the underlying PRIVMSG
+}
+
+// Report if the command was sent as a direct message.
+func (cmd *command) direct() bool {
+	return len(cmd.channel) == 0
+}
+
+// Determine where replies should go: the sender for direct messages,
+// the channel otherwise.
+func (cmd *command) replyTarget() string {
+	if cmd.direct() {
+		return cmd.nick
+	}
+	return cmd.channel
+}
+
+// Sends messages to IRC users and channels. Implemented by
+// *irc.Connection, allows replacing the connection in tests.
+type ircSender interface {
+	Privmsg(target, message string)
+}
+
+// Reply to a command where it came from. Replies in a channel are
+// addressed to the sender.
+func (cmd *command) reply(con ircSender, message string) {
+	if con == nil {
+		return
+	}
+	if cmd.direct() {
+		con.Privmsg(cmd.nick, message)
+		return
+	}
+	con.Privmsg(cmd.channel, cmd.nick+": "+message)
+}
+
+// A function implementing a command.
+type commandHandler func(cmd *command, con ircSender)
+
+// Parses PRIVMSGs into commands once and dispatches them
+// to the handlers registered for the command name.
+type commandRouter struct {
+	nick     func() string // current nick, may differ from the configured one
+	nicks    *nickMapper
+	handlers map[string]commandHandler
+	logger   *log.Logger
+}
+
+// Create a router for commands sent to the nick returned by nick (e.g.
+// GetNick() of the connection, mress may use a fallback nick).
+// Nicks are compared according to the casemapping of nicks.
+func newCommandRouter(nick func() string, nicks *nickMapper, logger *log.Logger) *commandRouter {
+	return &commandRouter{
+		nick:     nick,
+		nicks:    nicks,
+		handlers: make(map[string]commandHandler),
+		logger:   logger,
+	}
+}
+
+// Register a handler for a command name. Names are case insensitive
+// and every name can only be registered once.
+func (r *commandRouter) register(name string, handler commandHandler) error {
+	if len(name) == 0 {
+		return fmt.Errorf("command name of zero-length")
+	}
+	if 0 <= strings.IndexFunc(name, isSpace) {
+		return fmt.Errorf("command name not allowed to contain whitespace")
+	}
+	if handler == nil {
+		return fmt.Errorf("command handler is nil")
+	}
+	name = strings.ToLower(name)
+	if "help" == name {
+		return fmt.Errorf("command name 'help' is reserved")
+	}
+	if _, found := r.handlers[name]; found {
+		return fmt.Errorf("command '%s' already registered", name)
+	}
+	r.handlers[name] = handler
+	return nil
+}
+
+// List the names of all registered commands in alphabetical order.
+func (r *commandRouter) commands() []string {
+	names := make([]string, 0, len(r.handlers))
+	for name := range r.handlers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Parse a PRIVMSG and run the matching handler.
+// To be used as a callback for PRIVMSG.
+func (r *commandRouter) dispatch(e *irc.Event, con ircSender) {
+	// sanity checks
+	if e == nil {
+		return
+	}
+	if con == nil {
+		return
+	}
+	cmd := parseCommand(e, r.nick(), r.nicks)
+	if cmd == nil {
+		return
+	}
+	if "help" == cmd.name {
+		cmd.reply(con, "commands: "+strings.Join(r.commands(), ", "))
+		return
+	}
+	handler, found := r.handlers[cmd.name]
+	if !found {
+		return
+	}
+	if r.logger != nil {
+		r.logger.Println("running command " + cmd.name)
+	}
+	handler(cmd, con)
+}
+
+// Parse the message of a PRIVMSG into a command. Direct messages are
+// taken as they are, channel messages have to be addressed to the nick
+// ("nick: command ..." or "nick, command ..."). Nicks are compared
+// according to the casemapping of nicks. Returns nil if the message
+// is not a command.
+func parseCommand(e *irc.Event, nick string, nicks *nickMapper) *command {
+	// sanity checks
+	if e == nil {
+		return nil
+	}
+	if len(e.Arguments) == 0 {
+		return nil
+	}
+	if len(nick) == 0 {
+		return nil
+	}
+	text := strings.TrimSpace(e.Message())
+	// ignore OTR
+	if 0 == strings.Index(text, "?OTR") {
+		return nil
+	}
+
+	cmd := &command{nick: e.Nick, event: e}
+	if !nicks.equal(nick, e.Arguments[0]) {
+		// channel message, needs to be addressed to us
+		if len(text) < len(nick) || !nicks.equal(nick, text[:len(nick)]) {
+			return nil
+		}
+		text = text[len(nick):]
+		if 0 != strings.IndexAny(text, ":,") {
+			return nil
+		}
+		text = strings.TrimSpace(text[1:])
+		cmd.channel = e.Arguments[0]
+	}
+	if len(text) == 0 {
+		return nil
+	}
+
+	// split off the command name
+	end := strings.IndexFunc(text, isSpace)
+	if end < 0 {
+		end = len(text)
+	}
+	cmd.name = strings.ToLower(text[:end])
+	cmd.args = strings.TrimSpace(text[end:])
+	return cmd
+}
+
+// Report if a rune is whitespace as used to separate command arguments.
+func isSpace(r rune) bool {
+	return ' ' == r || '\t' == r
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"github.com/thoj/go-ircevent"
+	"sync"
+	"testing"
+)
+
+// an ircSender recording all messages instead of sending them
+type recordingSender struct {
+	mutex    sync.Mutex
+	messages []string // "target message"
+}
+
+func (r *recordingSender) Privmsg(target, message string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.messages = append(r.messages, target+" "+message)
+}
+
+// messages sent so far
+func (r *recordingSender) sent() []string {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return append([]string{}, r.messages...)
+}
+
+// a nick as returned by GetNick() of a connection
+func fixedNick(nick string) func() string {
+	return func() string { return nick }
+}
+
+// direct message
+func Test_parseCommand_0(t *testing.T) {
+	event := &irc.Event{Nick: "alice", Arguments: []string{"mress", "tell bob: hello there"}}
+	cmd := parseCommand(event, "mress", nil)
+	if cmd == nil {
+		t.Fatal("direct command not detected")
+	}
+	if "tell" != cmd.name {
+		t.Error("wrong command name (" + cmd.name + ")")
+	}
+	if "bob: hello there" != cmd.args {
+		t.Error("wrong arguments (" + cmd.args + ")")
+	}
+	if "alice" != cmd.nick {
+		t.Error("wrong sender")
+	}
+	if !cmd.direct() {
+		t.Error("direct message not detected")
+	}
+	if "alice" != cmd.replyTarget() {
+		t.Error("replies not sent to sender")
+	}
+}
+
+// channel message addressed to mress
+func Test_parseCommand_1(t *testing.T) {
+	event := &irc.Event{Nick: "alice", Arguments: []string{"#foo", "MRess: TELL bob: hello"}}
+	cmd := parseCommand(event, "mress", nil)
+	if cmd == nil {
+		t.Fatal("addressed command not detected")
+	}
+	if "tell" != cmd.name {
+		t.Error("wrong command name (" + cmd.name + ")")
+	}
+	if "bob: hello" != cmd.args {
+		t.Error("wrong arguments (" + cmd.args + ")")
+	}
+	if cmd.direct() {
+		t.Error("channel message taken as direct message")
+	}
+	if "#foo" != cmd.replyTarget() {
+		t.Error("replies not sent to channel")
+	}
+}
+
+// channel message with comma addressing
+func Test_parseCommand_2(t *testing.T) {
+	event := &irc.Event{Nick: "alice", Arguments: []string{"#foo", "mress,help"}}
+	cmd := parseCommand(event, "mress", nil)
+	if cmd == nil {
+		t.Fatal("addressed command not detected")
+	}
+	if "help" != cmd.name {
+		t.Error("wrong command name (" + cmd.name + ")")
+	}
+	if 0 != len(cmd.args) {
+		t.Error("arguments not empty")
+	}
+}
+
+// channel message not addressed to mress
+func Test_parseCommand_3(t *testing.T) {
+	event := &irc.Event{Nick: "alice", Arguments: []string{"#foo", "tell bob: hello"}}
+	if nil != parseCommand(event, "mress", nil) {
+		t.Error("unaddressed channel message taken as command")
+	}
+	event = &irc.Event{Nick: "alice", Arguments: []string{"#foo", "mressy: tell bob: hello"}}
+	if nil != parseCommand(event, "mress", nil) {
+		t.Error("message to other nick taken as command")
+	}
+}
+
+// OTR, empty messages, broken events
+func Test_parseCommand_4(t *testing.T) {
+	event := &irc.Event{Nick: "alice", Arguments: []string{"mress", "?OTR:AAMG"}}
+	if nil != parseCommand(event, "mress", nil) {
+		t.Error("OTR taken as command")
+	}
+	event = &irc.Event{Nick: "alice", Arguments: []string{"mress", "   "}}
+	if nil != parseCommand(event, "mress", nil) {
+		t.Error("empty message taken as command")
+	}
+	event = &irc.Event{Nick: "alice", Arguments: []string{"#foo", "mress:"}}
+	if nil != parseCommand(event, "mress", nil) {
+		t.Error("empty addressed message taken as command")
+	}
+	event = &irc.Event{Nick: "alice"}
+	if nil != parseCommand(event, "mress", nil) {
+		t.Error("event without arguments taken as command")
+	}
+	if nil != parseCommand(nil, "mress", nil) {
+		t.Error("nil event taken as command")
+	}
+}
+
+func Test_commandRouter_register_0(t *testing.T) {
+	router := newCommandRouter(fixedNick("mress"), nil, nil)
+	handler := func(cmd *command, con ircSender) {}
+	err := router.register("Tell", handler)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if 1 != len(router.commands()) || "tell" != router.commands()[0] {
+		t.Error("command not registered in lower case")
+	}
+	err = router.register("tell", handler)
+	if err == nil {
+		t.Error("duplicate registration not detected")
+	}
+}
+
+func Test_commandRouter_register_1(t *testing.T) {
+	router := newCommandRouter(fixedNick("mress"), nil, nil)
+	handler := func(cmd *command, con ircSender) {}
+	if nil == router.register("", handler) {
+		t.Error("empty command name not detected")
+	}
+	if nil == router.register("te ll", handler) {
+		t.Error("command name with space not detected")
+	}
+	if nil == router.register("tell", nil) {
+		t.Error("nil handler not detected")
+	}
+	if nil == router.register("help", handler) {
+		t.Error("reserved command name not detected")
+	}
+}
+
+// dispatch ignores non-commands and broken input
+func Test_commandRouter_dispatch_0(t *testing.T) {
+	router := newCommandRouter(fixedNick("mress"), nil, createLogger(""))
+	called := false
+	router.register("tell", func(cmd *command, con ircSender) {
+		called = true
+	})
+	con := &recordingSender{}
+	router.dispatch(&irc.Event{Nick: "alice", Arguments: []string{"#foo", "tell bob: hi"}}, con)
+	router.dispatch(&irc.Event{Nick: "alice", Arguments: []string{"mress", "unknown command"}}, con)
+	router.dispatch(nil, con)
+	router.dispatch(&irc.Event{Nick: "alice", Arguments: []string{"mress", "tell bob: hi"}}, nil)
+	if called {
+		t.Error("handler called for non-command")
+	}
+	router.dispatch(&irc.Event{Nick: "alice", Arguments: []string{"mress", "tell bob: hi"}}, con)
+	if !called {
+		t.Error("handler not called for command")
+	}
+}
+
+// help lists the commands
+func Test_commandRouter_dispatch_1(t *testing.T) {
+	t.Parallel()
+	router := newCommandRouter(fixedNick("mress"), nil, nil)
+	router.register("tell", func(cmd *command, con ircSender) {})
+	router.register("inbox", func(cmd *command, con ircSender) {})
+	con := &recordingSender{}
+	router.dispatch(&irc.Event{Nick: "alice", Arguments: []string{"#foo", "mress: help"}}, con)
+	sent := con.sent()
+	if 1 != len(sent) || "#foo alice: commands: inbox, tell" != sent[0] {
+		t.Error("wrong help reply")
+	}
+}
+
+// commands follow the current nick, e.g. a fallback nick
+func Test_commandRouter_dispatch_2(t *testing.T) {
+	t.Parallel()
+	nick := "mress"
+	router := newCommandRouter(func() string { return nick }, nil, nil)
+	called := 0
+	router.register("inbox", func(cmd *command, con ircSender) {
+		called++
+	})
+	con := &recordingSender{}
+	nick = "mress_"
+	router.dispatch(&irc.Event{Nick: "alice", Arguments: []string{"mress_", "inbox"}}, con)
+	if 1 != called {
+		t.Error("direct message to the fallback nick ignored")
+	}
+	// not a channel message addressed to mress
+	router.dispatch(&irc.Event{Nick: "alice", Arguments: []string{"mress_", "mress: inbox"}}, con)
+	router.dispatch(&irc.Event{Nick: "alice", Arguments: []string{"#foo", "mress: help"}}, con)
+	if 1 != called || 0 < len(con.sent()) {
+		t.Error("command for the configured nick taken")
+	}
+	router.dispatch(&irc.Event{Nick: "alice", Arguments: []string{"#foo", "mress_: inbox"}}, con)
+	if 2 != called {
+		t.Error("channel command to the fallback nick ignored")
+	}
+}
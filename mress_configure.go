@@ -7,6 +7,8 @@ import (
 	"io"
 	"log"
 	"os"
+	"strconv"
+	"strings"
 )
 
 // Create a Logger which logs to the given destination
@@ -57,181 +59,402 @@ func msgStdout(e *irc.Event) {
 	fmt.Println(e.Message())
 }
 
-// Build logger and choose commandline value over config file.
-// Return created logger through channel (to facilitate concurrent setups).
-func getLogger(destination, configfile string, logger chan *log.Logger) {
-	dest := ""
-	if len(destination) == 0 {
-		// read config
-		dest, _ = readConfigString(configfile, "maintainance", "log-destination", nil)
-	} else {
-		dest = destination
+// Settings of a channel mress joins.
+type channelConfig struct {
+	name            string
+	key             string // channel key (+k), if any
+	offlineMessages bool   // offline messages can be left and delivered
+	publicDelivery  bool   // messages left here are delivered here in public
+}
+
+// All settings of mress, loaded once by loadConfig().
+type Config struct {
+	file           string // config file the settings were read from
+	logDestination string
+	dbfile         string   // sqlite3 database of offline messages
+	keys           *keyring // to encrypt offline messages, never nil
+	offline        offlineSettings
+	networks       []networkConfig
+	// network the messages of the network "default" are moved to
+	// (stored before mress supported several networks), empty to
+	// keep them
+	legacyNetwork string
+}
+
+// Environment variables overriding settings of the config file, by
+// section and key. Settings of the section "IRC" apply to the network
+// configured there (the nickname also to listed networks), like flags.
+var envOverrides = map[string]string{
+	"IRC/server":                           "MRESS_SERVER",
+	"IRC/port":                             "MRESS_PORT",
+	"IRC/nickname":                         "MRESS_NICKNAME",
+	"IRC/password":                         "MRESS_PASSWORD",
+	"IRC/channels":                         "MRESS_CHANNEL",
+	"IRC/channel":                          "MRESS_CHANNEL",
+	"IRC/sasl-password":                    "MRESS_SASL_PASSWORD",
+	"IRC/nickserv-password":                "MRESS_NICKSERV_PASSWORD",
+	"offline messaging/dbfile":             "MRESS_DBFILE",
+	"offline messaging/encryption-keys":    "MRESS_ENCRYPTION_KEYS",
+	"offline messaging/encryption-keyfile": "MRESS_ENCRYPTION_KEYFILE",
+	"maintainance/log-destination":         "MRESS_LOG_DESTINATION",
+}
+
+// Reads settings with precedence commandline flags > environment
+// variables (see envOverrides) > config file > defaults and collects
+// every invalid setting.
+type configLoader struct {
+	ini    *goini.Config     // nil without config file
+	flags  map[string]string // flags set on the commandline by name
+	errors []error
+}
+
+// Load the config file (once) and take flags into account. Only
+// explicitly set flags override the config file, map them by name (see
+// flag.Visit). Reports all invalid settings at once.
+func loadConfig(file string, flags map[string]string) (*Config, []error) {
+	l := newConfigLoader(file, flags)
+	config := &Config{file: file}
+	config.logDestination = l.getString("log", "maintainance", "log-destination", "")
+	config.dbfile = l.getString("offline-msg-db", "offline messaging", "dbfile", "messages.db")
+	if 0 == len(config.dbfile) {
+		l.fail(l.source("offline-msg-db", "offline messaging", "dbfile"), "database filename of zero-length")
 	}
-	logger <- createLogger(dest)
-	return
+	config.keys = l.keyring()
+	config.offline = l.offlineSettings()
+	config.networks = l.networks()
+	config.legacyNetwork = l.legacyNetwork(config.networks)
+	return config, l.errors
 }
 
-// Get IRC channel and choose commandline value over config file.
-// Return IRC channel through channel (to facilitate concurrent setups).
-// A returning empty channel indicates errors.
-func getChannel(flag, configfile string, channel chan string, logger *log.Logger) {
-	if logger == nil {
-		channel <- ""
-		return
+// Create a loader reading the config file. A missing config file is
+// fine unless the flag "config" names it.
+func newConfigLoader(file string, flags map[string]string) *configLoader {
+	l := &configLoader{flags: flags}
+	if l.flags == nil {
+		l.flags = make(map[string]string)
 	}
-	if len(flag) == 0 {
-		irc, err := readConfigString(configfile, "IRC", "channel", logger)
+	_, explicit := l.flags["config"]
+	if _, err := os.Stat(file); err == nil || explicit {
+		l.ini, err = goini.LoadConfig(file)
 		if err != nil {
-			logger.Println(err.Error())
-			channel <- ""
-			return
+			l.errors = append(l.errors, fmt.Errorf("loading config file %s failed: %v", file, err))
 		}
-		channel <- irc
-	} else {
-		channel <- flag
 	}
-	return
+	return l
 }
 
-// Get IRC nickname and choose commandline value over config file.
-// Return IRC nickname through channel (to facilitate concurrent setups).
-// A returning empty nick indicates errors.
-func getNick(inick, configfile string, channel chan string, logger *log.Logger) {
-	if logger == nil {
-		return
+// Look up a setting, the flag (if set) over the environment over the
+// config file. Reports whether the setting was found.
+func (l *configLoader) lookup(flag, section, key string) (string, bool) {
+	if 0 < len(flag) {
+		if value, found := l.flags[flag]; found {
+			return strings.TrimSpace(value), true
+		}
 	}
-	cnick, _ := readConfigString(configfile, "IRC", "nickname", logger)
-	// if emtpy flag -> choose config
-	if len(inick) == 0 {
-		channel <- cnick
-		return
+	if name, found := envOverrides[section+"/"+key]; found {
+		if value, found := os.LookupEnv(name); found {
+			return strings.TrimSpace(value), true
+		}
 	}
-	//choose config over default value
-	if "mress" == inick {
-		//default and config value -> config
-		channel <- cnick
-	} else {
-		//non-default flag -> flag (over config)
-		channel <- inick
+	if l.ini == nil || 0 == len(section) || 0 == len(key) {
+		return "", false
+	}
+	sec := l.ini.GetSection(section)
+	if sec == nil {
+		return "", false
 	}
-	return
+	value, err := sec.GetString(key)
+	if err != nil {
+		return "", false
+	}
+	return strings.TrimSpace(value), true
 }
 
-// Get IRC server/hostname and choose commandline value over config file.
-// Return IRC server through channel (to facilitate concurrent setups).
-func getPassword(ipasswd, configfile string, channel chan string, logger *log.Logger) {
-	if logger == nil {
-		return
+// Describe where a setting came from, for error messages.
+func (l *configLoader) source(flag, section, key string) string {
+	if _, found := l.flags[flag]; 0 < len(flag) && found {
+		return "flag -" + flag
 	}
-	cpasswd, _ := readConfigString(configfile, "IRC", "password", logger)
-	//choose config over default value
-	if len(ipasswd) == 0 {
-		//default and config value -> config
-		channel <- cpasswd
-	} else {
-		//non-default flag -> flag (over config)
-		channel <- ipasswd
+	if name, found := envOverrides[section+"/"+key]; found {
+		if _, found := os.LookupEnv(name); found {
+			return "environment variable " + name
+		}
 	}
+	return "[" + section + "] " + key
 }
 
-// Get IRC server/hostname and choose commandline value over config file.
-// Return IRC server through channel (to facilitate concurrent setups).
-func getServer(iserver, configfile string, channel chan string, logger *log.Logger) {
-	if logger == nil {
-		return
-	}
-	cserver, _ := readConfigString(configfile, "IRC", "server", logger)
-	//choose config over default value
-	if len(iserver) == 0 {
-		//default and config value -> config
-		channel <- cserver
-	} else {
-		//non-default flag -> flag (over config)
-		channel <- iserver
+// Remember an invalid setting.
+func (l *configLoader) fail(source, format string, args ...interface{}) {
+	l.errors = append(l.errors, fmt.Errorf(source+": "+format, args...))
+}
+
+// Get a string setting, fallback if it is not set.
+func (l *configLoader) getString(flag, section, key, fallback string) string {
+	value, found := l.lookup(flag, section, key)
+	if !found {
+		return fallback
 	}
+	return value
 }
 
-// Get port to connect to and choose commandline value over config file.
-// Return IRC server through channel (to facilitate concurrent setups).
-// A port number of 0 indicates errors.
-func getPort(iport int, configfile string, channel chan int, logger *log.Logger) {
-	if logger == nil {
-		return
+// Get an integer setting of at least min, fallback if it is not set.
+func (l *configLoader) getInt(flag, section, key string, fallback, min int) int {
+	value, found := l.lookup(flag, section, key)
+	if !found || 0 == len(value) {
+		return fallback
 	}
-	cport, err := readConfigInt(configfile, "IRC", "port", logger)
+	number, err := strconv.Atoi(value)
 	if err != nil {
-		logger.Println(err.Error())
-		channel <- 0
-		return
-	}
-	//choose config over "empty" value
-	if iport == 0 {
-		//default and config value -> config
-		channel <- cport
+		l.fail(l.source(flag, section, key), "'%s' is no number", value)
+		return fallback
+	}
+	if number < min {
+		l.fail(l.source(flag, section, key), "%d is less than %d", number, min)
+		return fallback
+	}
+	return number
+}
+
+// Get a boolean setting (true/false, yes/no, on/off, 1/0), fallback if
+// it is not set.
+func (l *configLoader) getBool(flag, section, key string, fallback bool) bool {
+	value, found := l.lookup(flag, section, key)
+	if !found || 0 == len(value) {
+		return fallback
+	}
+	switch strings.ToLower(value) {
+	case "true", "yes", "on", "1":
+		return true
+	case "false", "no", "off", "0":
+		return false
+	}
+	l.fail(l.source(flag, section, key), "'%s' is no boolean (use yes or no)", value)
+	return fallback
+}
+
+// Get a comma separated list, empty entries are dropped.
+func (l *configLoader) getList(flag, section, key string) []string {
+	list := []string{}
+	value, _ := l.lookup(flag, section, key)
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if 0 < len(entry) {
+			list = append(list, entry)
+		}
+	}
+	return list
+}
+
+// Get the keys to encrypt offline messages with. The key file given on
+// the commandline, the environment or in the config file
+// (encryption-keyfile) is chosen over listed keys (encryption-keys =
+// id:key, ...), current key first. An empty keyring disables encryption.
+func (l *configLoader) keyring() *keyring {
+	var keys *keyring
+	var err error
+	source := l.source("offline-keyfile", "offline messaging", "encryption-keyfile")
+	keyfile := l.getString("offline-keyfile", "offline messaging", "encryption-keyfile", "")
+	if 0 < len(keyfile) {
+		keys, err = readKeyFile(keyfile)
 	} else {
-		//non-default flag -> flag (over config)
-		channel <- iport
+		source = l.source("", "offline messaging", "encryption-keys")
+		keys, err = parseKeyring(l.getList("", "offline messaging", "encryption-keys"))
 	}
+	if err != nil {
+		l.fail(source, "%v", err)
+		keys, _ = parseKeyring(nil)
+	}
+	return keys
 }
 
-// read name of database file for offline messages
-func getOfflineDBfilename(dbfile, configfile string, channel chan string, logger *log.Logger) {
-	cdb, err := readConfigString(configfile, "offline messaging", "dbfile", logger)
+// Get the settings of the offline messenger: push-limit (0 for no
+// limit), max-age (e.g. 30d, 0 keeps messages forever), notify-expired,
+// the quota (0 for no limit) and the scope ("network" or "channel").
+func (l *configLoader) offlineSettings() offlineSettings {
+	const section = "offline messaging"
+	settings := offlineSettings{quota: defaultOfflineQuota}
+	settings.pushLimit = l.getInt("offline-push-limit", section, "push-limit", defaultPushLimit, 0)
+	age := l.getString("offline-max-age", section, "max-age", "")
+	maxAge, err := parseMaxAge(age)
 	if err != nil {
-		logger.Println(err.Error())
-		channel <- ""
-		return
+		l.fail(l.source("offline-max-age", section, "max-age"), "%v", err)
 	}
-	//choose config over "empty" value
-	if len(dbfile) == 0 {
-		channel <- cdb
-	} else {
-		channel <- dbfile
+	settings.maxAge = maxAge
+	settings.notifyExpired = l.getBool("", section, "notify-expired", false)
+	settings.quota.perSender = l.getInt("", section, "max-pending-per-sender", settings.quota.perSender, 0)
+	settings.quota.perRecipient = l.getInt("", section, "max-pending-per-recipient", settings.quota.perRecipient, 0)
+	settings.quota.total = l.getInt("", section, "max-pending", settings.quota.total, 0)
+	settings.quota.maxLength = l.getInt("", section, "max-length", settings.quota.maxLength, 0)
+	settings.scope = strings.ToLower(l.getString("", section, "scope", scopeNetwork))
+	if scopeNetwork != settings.scope && scopeChannel != settings.scope {
+		l.fail(l.source("", section, "scope"), "unknown scope '%s' (use network or channel)", settings.scope)
+		settings.scope = scopeNetwork
 	}
+	return settings
 }
 
-// Read string from config file
-func readConfigString(filename, section, key string, logger *log.Logger) (string, error) {
-	if logger == nil {
-		return "", fmt.Errorf("logger nil pointer\n")
+// Get the channels of a network listed comma separated (channels =
+// #a, #b), a single channel is read from "channel" as before. Every
+// channel can have a section "channel <network> <name>" or, shared by
+// all networks, "channel <name>" with its settings: key,
+// offline-messages (default yes) and public-delivery (default no).
+func (l *configLoader) channels(network, flag, section string) []channelConfig {
+	names := l.getList(flag, section, "channels")
+	if _, found := l.flags[flag]; !found && 0 == len(names) {
+		names = l.getList("", section, "channel")
 	}
-	conf, err := goini.LoadConfig(filename)
-	if err != nil {
-		return "", fmt.Errorf("failed to load configuration\n")
+	channels := []channelConfig{}
+	seen := make(map[string]bool)
+	for _, name := range names {
+		if !strings.ContainsAny(name[:1], "#&+!") || strings.ContainsAny(name, " ,\a") {
+			l.fail(l.source(flag, section, "channels"), "'%s' is no channel name", name)
+			continue
+		}
+		if seen[strings.ToLower(name)] {
+			l.fail(l.source(flag, section, "channels"), "channel %s listed twice", name)
+			continue
+		}
+		seen[strings.ToLower(name)] = true
+		channels = append(channels, channelConfig{
+			name:            name,
+			key:             l.getString("", l.channelSection(network, name, "key"), "key", ""),
+			offlineMessages: l.getBool("", l.channelSection(network, name, "offline-messages"), "offline-messages", true),
+			publicDelivery:  l.getBool("", l.channelSection(network, name, "public-delivery"), "public-delivery", false),
+		})
 	}
-	if len(section) == 0 {
-		return "", fmt.Errorf("empty section string\n")
+	return channels
+}
+
+// Get the section to read a setting of a channel from, the section of
+// the channel in the network if it has the setting, the shared one
+// otherwise.
+func (l *configLoader) channelSection(network, name, key string) string {
+	section := "channel " + network + " " + name
+	if _, found := l.lookup("", section, key); found {
+		return section
 	}
-	sec := conf.GetSection(section)
-	if sec == nil {
-		return "", fmt.Errorf("failed to load " + section + " section\n")
+	return "channel " + name
+}
+
+// Get the networks to connect to. Networks are listed comma separated
+// in the section "IRC" (networks = a, b), each configured in a section
+// "network <name>". Without a list, the network configured in "IRC"
+// and by flags is the only network, named defaultNetwork. The flag
+// "use-tls" disables TLS for all networks.
+func (l *configLoader) networks() []networkConfig {
+	// settings of "IRC" are the defaults of all networks
+	fallback := l.network(defaultNetwork, "IRC", networkConfig{port: 6697, useTLS: true, nick: "mress"}, true)
+	names := l.getList("", "IRC", "networks")
+	networks := []networkConfig{}
+	seen := make(map[string]bool)
+	for _, name := range names {
+		if seen[name] {
+			l.fail(l.source("", "IRC", "networks"), "network %s listed twice", name)
+			continue
+		}
+		seen[name] = true
+		section := "network " + name
+		if l.ini == nil || l.ini.GetSection(section) == nil {
+			l.fail("["+section+"]", "section missing")
+			continue
+		}
+		defaults := networkConfig{port: 6697, useTLS: true, nick: fallback.nick, maxRetries: fallback.maxRetries}
+		networks = append(networks, l.network(name, section, defaults, false))
 	}
-	value, err := sec.GetString(key)
-	if err != nil {
-		return "", fmt.Errorf("failed to get the " + key + " value")
+	if 0 == len(names) {
+		networks = append(networks, fallback)
 	}
-	return value, nil
+
+	useTLS := l.getBool("use-tls", "", "", true)
+	for i := range networks {
+		network := &networks[i]
+		network.useTLS = network.useTLS && useTLS
+		section := "network " + network.name
+		if defaultNetwork == network.name && 0 == len(names) {
+			section = "IRC"
+		}
+		if 0 == len(network.server) {
+			l.fail("["+section+"] server", "no server configured")
+		}
+		err := network.sasl.validate(network.useTLS, network.tls.clientCert())
+		if err != nil {
+			l.fail("["+section+"] sasl-mechanism", "%v", err)
+		}
+	}
+	return networks
 }
 
-// Read integer from config file
-func readConfigInt(filename, section, key string, logger *log.Logger) (int, error) {
-	if logger == nil {
-		return 0, fmt.Errorf("logger nil pointer\n")
+// Get the network the messages of the network "default" are moved to,
+// it has to be one of networks.
+func (l *configLoader) legacyNetwork(networks []networkConfig) string {
+	name := l.getString("", "IRC", "legacy-network", "")
+	if 0 == len(name) {
+		return ""
 	}
-	conf, err := goini.LoadConfig(filename)
-	if err != nil {
-		return 0, fmt.Errorf("failed to load configuration\n")
+	for _, network := range networks {
+		if name == network.name && defaultNetwork != name {
+			return name
+		}
 	}
-	if len(section) == 0 {
-		return 0, fmt.Errorf("empty section string\n")
+	l.fail(l.source("", "IRC", "legacy-network"), "%s is not listed in networks", name)
+	return ""
+}
+
+// Get the settings of a network from a section, starting from
+// defaults. withFlags takes the flags for the network configured in
+// "IRC" into account.
+func (l *configLoader) network(name, section string, defaults networkConfig, withFlags bool) networkConfig {
+	flag := func(name string) string {
+		if withFlags {
+			return name
+		}
+		return ""
 	}
-	sec := conf.GetSection(section)
-	if sec == nil {
-		return 0, fmt.Errorf("failed to load " + section + " section\n")
+	network := defaults
+	network.name = name
+	network.server = l.getString(flag("server"), section, "server", defaults.server)
+	network.port = l.getInt(flag("port"), section, "port", defaults.port, 1)
+	if 65535 < network.port {
+		l.fail(l.source(flag("port"), section, "port"), "%d is no port number", network.port)
 	}
-	value, err := sec.GetInt(key)
-	if err != nil {
-		return 0, fmt.Errorf("failed to get the " + key + " value")
+	if !withFlags {
+		network.useTLS = l.getBool("", section, "use-tls", defaults.useTLS)
+	}
+	network.nick = l.getString(flag("nick"), section, "nickname", defaults.nick)
+	// inherited nicks are checked where they are set
+	if (withFlags || network.nick != defaults.nick) && (0 == len(network.nick) || strings.ContainsAny(network.nick, " ,:!@")) {
+		l.fail(l.source(flag("nick"), section, "nickname"), "'%s' is no nickname", network.nick)
+	}
+	network.password = l.getString(flag("passwd"), section, "password", "")
+	network.channels = l.channels(name, flag("channel"), section)
+	network.maxRetries = l.getInt(flag("max-retries"), section, "max-retries", defaults.maxRetries, 0)
+
+	network.tls = tlsOptions{
+		certFile:     l.getString("", section, "client-cert", ""),
+		keyFile:      l.getString("", section, "client-key", ""),
+		caFile:       l.getString("", section, "ca-file", ""),
+		minVersion:   l.getString("", section, "tls-min-version", ""),
+		fingerprints: []string{},
+	}
+	for _, pin := range l.getList("", section, "tls-fingerprint") {
+		network.tls.fingerprints = append(network.tls.fingerprints, normalizeFingerprint(pin))
+	}
+	if err := network.tls.validate(); err != nil {
+		l.fail("["+section+"] TLS", "%v", err)
+	}
+
+	network.sasl = saslConfig{
+		mechanism: strings.ToUpper(l.getString("", section, "sasl-mechanism", "")),
+		login:     l.getString("", section, "sasl-login", ""),
+		password:  l.getString("", section, "sasl-password", ""),
+	}
+
+	network.nickserv = nickServConfig{
+		password: l.getString("", section, "nickserv-password", ""),
+		recover:  strings.ToLower(l.getString("", section, "nickserv-recover", recoverRegain)),
+	}
+	if err := network.nickserv.validate(); err != nil {
+		l.fail(l.source("", section, "nickserv-recover"), "%v", err)
 	}
-	return value, nil
+	return network
 }
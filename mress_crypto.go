@@ -0,0 +1,137 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+)
+
+// Keys to encrypt content with AES-256-GCM (authenticated encryption).
+// New content is encrypted with the current key, older keys are kept to
+// decrypt content written before the keys were rotated.
+type keyring struct {
+	current string                 // id of the key used for encryption
+	ciphers map[string]cipher.AEAD // key id -> cipher
+}
+
+// Create a keyring from entries "<id>:<base64 encoded 32 byte key>".
+// The first entry is the current key. No entries give an empty keyring.
+func parseKeyring(entries []string) (*keyring, error) {
+	keys := &keyring{ciphers: make(map[string]cipher.AEAD)}
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if len(entry) == 0 {
+			continue
+		}
+		separator := strings.Index(entry, ":")
+		if 1 > separator {
+			return nil, fmt.Errorf("key entry without id")
+		}
+		id := entry[:separator]
+		if 0 <= strings.IndexFunc(id, isSpace) {
+			return nil, fmt.Errorf("key id not allowed to contain whitespace")
+		}
+		if _, found := keys.ciphers[id]; found {
+			return nil, fmt.Errorf("duplicate key id " + id)
+		}
+		key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(entry[separator+1:]))
+		if err != nil {
+			return nil, fmt.Errorf("key " + id + " is not base64 encoded")
+		}
+		if 32 != len(key) {
+			return nil, fmt.Errorf("key " + id + " is not 32 bytes long")
+		}
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, fmt.Errorf("creating cipher for key %s failed: %v", id, err)
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, fmt.Errorf("creating cipher for key %s failed: %v", id, err)
+		}
+		keys.ciphers[id] = aead
+		if 0 == len(keys.current) {
+			keys.current = id
+		}
+	}
+	return keys, nil
+}
+
+// Read a keyring from a file with one entry per line, the current key
+// first. Empty lines and lines starting with # are ignored.
+// See also parseKeyring()
+func readKeyFile(filename string) (*keyring, error) {
+	content, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("reading key file failed: %v", err)
+	}
+	entries := []string{}
+	for _, line := range strings.Split(string(content), "\n") {
+		if 0 == strings.Index(strings.TrimSpace(line), "#") {
+			continue
+		}
+		entries = append(entries, line)
+	}
+	return parseKeyring(entries)
+}
+
+// Report if there are keys to encrypt with.
+func (k *keyring) enabled() bool {
+	return k != nil && 0 < len(k.current)
+}
+
+// List the ids of all keys in alphabetical order.
+func (k *keyring) ids() []string {
+	ids := []string{}
+	if k == nil {
+		return ids
+	}
+	for id := range k.ciphers {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// Encrypt content with the current key, authenticating the additional
+// data along with it. Returns the id of the key used and the sealed
+// content as base64(nonce+ciphertext).
+func (k *keyring) encrypt(content string, data []byte) (id, sealed string, err error) {
+	if !k.enabled() {
+		return "", "", fmt.Errorf("no encryption key")
+	}
+	aead := k.ciphers[k.current]
+	nonce := make([]byte, aead.NonceSize())
+	_, err = rand.Read(nonce)
+	if err != nil {
+		return "", "", fmt.Errorf("generating nonce failed: %v", err)
+	}
+	ciphertext := aead.Seal(nonce, nonce, []byte(content), data)
+	return k.current, base64.StdEncoding.EncodeToString(ciphertext), nil
+}
+
+// Decrypt content sealed with the key id, the additional data has to
+// be the same as when encrypting.
+func (k *keyring) decrypt(id, sealed string, data []byte) (string, error) {
+	if k == nil {
+		return "", fmt.Errorf("no key to decrypt content")
+	}
+	aead, found := k.ciphers[id]
+	if !found {
+		return "", fmt.Errorf("unknown key " + id)
+	}
+	ciphertext, err := base64.StdEncoding.DecodeString(sealed)
+	if err != nil || len(ciphertext) < aead.NonceSize() {
+		return "", fmt.Errorf("malformed encrypted content")
+	}
+	plain, err := aead.Open(nil, ciphertext[:aead.NonceSize()], ciphertext[aead.NonceSize():], data)
+	if err != nil {
+		return "", fmt.Errorf("decrypting content failed: %v", err)
+	}
+	return string(plain), nil
+}
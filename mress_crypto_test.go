@@ -0,0 +1,118 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// keys for testing
+const (
+	testKey1 = "k1:kiY4h7sHHmiSUwYbIbIpU3uF5klk5gwnG0Jz+EkOoQs="
+	testKey2 = "k2:fjaX8LWAU/2h+BvRH0j3eJMtLs8ZG2lwGzGOfzDJ72I="
+)
+
+func Test_parseKeyring_0(t *testing.T) {
+	t.Parallel()
+	keys, err := parseKeyring([]string{" " + testKey2, testKey1, ""})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if "k2" != keys.current || 2 != len(keys.ciphers) {
+		t.Error("first key not used as current key")
+	}
+	keys, err = parseKeyring(nil)
+	if err != nil || keys.enabled() {
+		t.Error("empty keyring not empty")
+	}
+}
+
+func Test_parseKeyring_1(t *testing.T) {
+	t.Parallel()
+	broken := []string{
+		"kiY4h7sHHmiSUwYbIbIpU3uF5klk5gwnG0Jz+EkOoQs=",
+		":kiY4h7sHHmiSUwYbIbIpU3uF5klk5gwnG0Jz+EkOoQs=",
+		"k 1:kiY4h7sHHmiSUwYbIbIpU3uF5klk5gwnG0Jz+EkOoQs=",
+		"k1:not base64!",
+		"k1:c2hvcnQ=",
+	}
+	for _, entry := range broken {
+		if _, err := parseKeyring([]string{entry}); err == nil {
+			t.Error("broken key accepted: " + entry)
+		}
+	}
+	if _, err := parseKeyring([]string{testKey1, testKey1}); err == nil {
+		t.Error("duplicate key id accepted")
+	}
+}
+
+func Test_readKeyFile_0(t *testing.T) {
+	t.Parallel()
+	filename := filepath.Join(t.TempDir(), "keys")
+	content := "# current key first\n" + testKey2 + "\n\n" + testKey1 + "\n"
+	if err := ioutil.WriteFile(filename, []byte(content), 0600); err != nil {
+		t.Fatal(err.Error())
+	}
+	keys, err := readKeyFile(filename)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if "k2" != keys.current || 2 != len(keys.ciphers) {
+		t.Error("key file not read correctly")
+	}
+	if _, err = readKeyFile(filename + "-missing"); err == nil {
+		t.Error("missing key file not detected")
+	}
+}
+
+// round trip, old keys still decrypt after rotation
+func Test_keyring_encrypt_0(t *testing.T) {
+	t.Parallel()
+	old, _ := parseKeyring([]string{testKey1})
+	rotated, _ := parseKeyring([]string{testKey2, testKey1})
+	data := []byte("1")
+	id, encrypted, err := old.encrypt("hello bob", data)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if strings.Contains(encrypted, "hello") || "k1" != id {
+		t.Error("content not encrypted: " + encrypted)
+	}
+	plain, err := rotated.decrypt(id, encrypted, data)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if "hello bob" != plain {
+		t.Error("decrypted wrong content: " + plain)
+	}
+	_, again, _ := old.encrypt("hello bob", data)
+	if again == encrypted {
+		t.Error("nonce reused")
+	}
+}
+
+// tampering, unknown keys and other additional data
+func Test_keyring_decrypt_0(t *testing.T) {
+	t.Parallel()
+	keys, _ := parseKeyring([]string{testKey1})
+	other, _ := parseKeyring([]string{testKey2})
+	data := []byte("1")
+	id, encrypted, _ := keys.encrypt("hello bob", data)
+	if _, err := other.decrypt(id, encrypted, data); err == nil {
+		t.Error("unknown key not detected")
+	}
+	tampered := encrypted[:len(encrypted)-4] + "AAA="
+	if _, err := keys.decrypt(id, tampered, data); err == nil {
+		t.Error("tampered content not detected")
+	}
+	if _, err := keys.decrypt(id, encrypted, []byte("2")); err == nil {
+		t.Error("other additional data not detected")
+	}
+	if _, err := keys.decrypt(id, "not base64", data); err == nil {
+		t.Error("malformed content not detected")
+	}
+	if _, _, err := (*keyring)(nil).encrypt("hello", data); err == nil {
+		t.Error("encryption without key not detected")
+	}
+}
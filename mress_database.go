@@ -0,0 +1,219 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// A step in the evolution of the database schema. Migrations are run
+// inside a transaction together with the update of the schema version.
+type migration func(tx *sql.Tx) error
+
+// All schema migrations in order. The schema version of a database
+// (PRAGMA user_version) is the number of migrations applied to it.
+// Only ever append to this list, never remove entries.
+var migrations = []migration{
+	// 1: offline messages (up to v0.25)
+	func(tx *sql.Tx) error {
+		_, err := tx.Exec(`CREATE TABLE IF NOT EXISTS messages (target TEXT, source TEXT, content TEXT)`)
+		return err
+	},
+	// 2: time, context and delivery of offline messages, older messages
+	// count as left at the time of the migration
+	func(tx *sql.Tx) error {
+		err := addColumn(tx, "messages", "created", "INTEGER NOT NULL DEFAULT 0")
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec("UPDATE messages SET created = strftime('%s','now') WHERE created = 0")
+		if err != nil {
+			return err
+		}
+		err = addColumn(tx, "messages", "context", "TEXT NOT NULL DEFAULT ''")
+		if err != nil {
+			return err
+		}
+		return addColumn(tx, "messages", "delivered", "INTEGER")
+	},
+	// 3: case insensitive lookup of nicks (folded with the rfc1459
+	// default, messages are rekeyed once the server tells otherwise)
+	func(tx *sql.Tx) error {
+		err := addColumn(tx, "messages", "target_key", "TEXT NOT NULL DEFAULT ''")
+		if err != nil {
+			return err
+		}
+		err = addColumn(tx, "messages", "source_key", "TEXT NOT NULL DEFAULT ''")
+		if err != nil {
+			return err
+		}
+		err = rekeyMessages(tx, rfc1459Mapping.fold, "")
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec("CREATE INDEX IF NOT EXISTS messages_target_key ON messages (target_key)")
+		return err
+	},
+	// 4: public delivery of offline messages (ptell)
+	func(tx *sql.Tx) error {
+		return addColumn(tx, "messages", "public", "INTEGER NOT NULL DEFAULT 0")
+	},
+	// 5: several networks in one database, messages stored before
+	// belong to the network "default"
+	func(tx *sql.Tx) error {
+		err := addColumn(tx, "messages", "network", "TEXT NOT NULL DEFAULT 'default'")
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec("CREATE INDEX IF NOT EXISTS messages_network_target_key ON messages (network, target_key)")
+		return err
+	},
+	// 6: only the metadata of delivered messages is kept
+	func(tx *sql.Tx) error {
+		_, err := tx.Exec("UPDATE messages SET content = '' WHERE delivered IS NOT NULL")
+		return err
+	},
+	// 7: encrypted content, content_key names the key (plain text if
+	// empty)
+	func(tx *sql.Tx) error {
+		return addColumn(tx, "messages", "content_key", "TEXT NOT NULL DEFAULT ''")
+	},
+	// 8: stable message ids shown to users (the rowid may change on
+	// VACUUM and the highest gets reused), keeping the ids so far
+	func(tx *sql.Tx) error {
+		statements := []string{
+			`CREATE TABLE messages_ids (
+				id INTEGER PRIMARY KEY AUTOINCREMENT,
+				network TEXT NOT NULL DEFAULT 'default',
+				target TEXT, target_key TEXT NOT NULL DEFAULT '',
+				source TEXT, source_key TEXT NOT NULL DEFAULT '',
+				content TEXT, content_key TEXT NOT NULL DEFAULT '',
+				created INTEGER NOT NULL DEFAULT 0,
+				context TEXT NOT NULL DEFAULT '',
+				delivered INTEGER,
+				public INTEGER NOT NULL DEFAULT 0)`,
+			`INSERT INTO messages_ids (id, network, target, target_key, source, source_key, content, content_key, created, context, delivered, public)
+				SELECT rowid, network, target, target_key, source, source_key, content, content_key, created, context, delivered, public FROM messages`,
+			"DROP TABLE messages",
+			"ALTER TABLE messages_ids RENAME TO messages",
+			"CREATE INDEX messages_target_key ON messages (target_key)",
+			"CREATE INDEX messages_network_target_key ON messages (network, target_key)",
+		}
+		for _, statement := range statements {
+			if _, err := tx.Exec(statement); err != nil {
+				return err
+			}
+		}
+		return nil
+	},
+	// 9: expiry notifications are marked, mress may have stored them
+	// under any of its nicks
+	func(tx *sql.Tx) error {
+		return addColumn(tx, "messages", "notice", "INTEGER NOT NULL DEFAULT 0")
+	},
+}
+
+// Open a database file and bring its schema up to date. The handle
+// is meant to be opened once and shared by all features.
+// Databases with a schema newer than known are rejected.
+func openDatabase(filename string) (*sql.DB, error) {
+	if len(filename) == 0 {
+		return nil, fmt.Errorf("empty filename given")
+	}
+	db, err := sql.Open("sqlite3", filename)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open database file: %v", err)
+	}
+	// sqlite allows only one writer at a time, so the pool hands out
+	// a single connection instead of running into locking errors
+	db.SetMaxOpenConns(1)
+	err = migrateDatabase(db)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+// Apply all migrations missing in a database, one transaction each.
+func migrateDatabase(db *sql.DB) error {
+	if db == nil {
+		return fmt.Errorf("database pointer is nil")
+	}
+	version, err := schemaVersion(db)
+	if err != nil {
+		return err
+	}
+	if version > len(migrations) {
+		return fmt.Errorf("database schema version %d is newer than supported version %d", version, len(migrations))
+	}
+	for ; version < len(migrations); version++ {
+		tx, err := db.Begin()
+		if err != nil {
+			return fmt.Errorf("beginning transaction failed: %v", err)
+		}
+		err = migrations[version](tx)
+		if err != nil {
+			tx.Rollback()
+			return fmt.Errorf("migration to schema version %d failed: %v", version+1, err)
+		}
+		// PRAGMA does not take parameters
+		_, err = tx.Exec(fmt.Sprintf("PRAGMA user_version = %d", version+1))
+		if err != nil {
+			tx.Rollback()
+			return fmt.Errorf("updating schema version failed: %v", err)
+		}
+		err = tx.Commit()
+		if err != nil {
+			return fmt.Errorf("commiting migration to schema version %d failed: %v", version+1, err)
+		}
+	}
+	return nil
+}
+
+// Read the schema version of a database.
+func schemaVersion(db *sql.DB) (int, error) {
+	version := 0
+	err := db.QueryRow("PRAGMA user_version").Scan(&version)
+	if err != nil {
+		return 0, fmt.Errorf("reading schema version failed: %v", err)
+	}
+	return version, nil
+}
+
+// Add a column to a table unless it already exists.
+func addColumn(tx *sql.Tx, table, column, definition string) error {
+	rows, err := tx.Query(fmt.Sprintf("PRAGMA table_info(%s)", table))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	columns, err := rows.Columns()
+	if err != nil {
+		return err
+	}
+	values := make([]interface{}, len(columns))
+	name := sql.NullString{}
+	for i := range values {
+		if "name" == columns[i] {
+			values[i] = &name
+		} else {
+			values[i] = new(interface{})
+		}
+	}
+	for rows.Next() {
+		err = rows.Scan(values...)
+		if err != nil {
+			return err
+		}
+		if column == name.String {
+			return nil
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return err
+	}
+	rows.Close()
+	_, err = tx.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition))
+	return err
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	_ "github.com/mattn/go-sqlite3"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// database file with the schema of the given version and rows
+// inserted by statements, closed again
+func createTestDatabase(t *testing.T, version int, statements ...string) string {
+	dbfile := filepath.Join(t.TempDir(), "testschema.db")
+	db, err := sql.Open("sqlite3", dbfile)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer db.Close()
+	for _, migrate := range migrations[:version] {
+		tx, err := db.Begin()
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if err = migrate(tx); err != nil {
+			t.Fatal(err.Error())
+		}
+		tx.Commit()
+	}
+	_, err = db.Exec(fmt.Sprintf("PRAGMA user_version = %d", version))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	for _, statement := range statements {
+		if _, err = db.Exec(statement); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	return dbfile
+}
+
+// new database gets the current schema
+func Test_openDatabase_0(t *testing.T) {
+	t.Parallel()
+	dbfile := filepath.Join(t.TempDir(), "testschema.db")
+	db, err := openDatabase(dbfile)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer db.Close()
+	version, err := schemaVersion(db)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(migrations) != version {
+		t.Error("database not migrated to current schema")
+	}
+}
+
+func Test_openDatabase_1(t *testing.T) {
+	t.Parallel()
+	_, err := openDatabase("")
+	if err == nil {
+		t.Error("empty filename did not yield error")
+	}
+}
+
+// database of v0.25 is upgraded and keeps its messages
+func Test_openDatabase_2(t *testing.T) {
+	t.Parallel()
+	dbfile := filepath.Join(t.TempDir(), "testschema.db")
+	db, err := sql.Open("sqlite3", dbfile)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS messages (target TEXT, source TEXT, content TEXT);`)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	_, err = db.Exec("INSERT INTO messages (target, source, content) VALUES ('testuser', 'testsource', 'old message')")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	db.Close()
+
+	db, err = openDatabase(dbfile)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer db.Close()
+	store, err := newSQLiteMessageStore(db, defaultNetwork)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer store.close()
+	messages, err := store.takePending("testuser", time.Now(), nil)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if 1 != len(messages) || "old message" != messages[0].content {
+		t.Fatal("message lost in migration")
+	}
+	if time.Since(messages[0].created) > time.Minute {
+		t.Error("message not dated to the migration")
+	}
+}
+
+// newer schema is refused
+func Test_openDatabase_3(t *testing.T) {
+	t.Parallel()
+	dbfile := filepath.Join(t.TempDir(), "testschema.db")
+	db, err := sql.Open("sqlite3", dbfile)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	_, err = db.Exec("PRAGMA user_version = 9999")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	db.Close()
+
+	db, err = openDatabase(dbfile)
+	if err == nil {
+		db.Close()
+		t.Error("newer schema version not detected")
+	}
+}
+
+// migrating twice does nothing
+func Test_migrateDatabase_0(t *testing.T) {
+	t.Parallel()
+	dbfile := filepath.Join(t.TempDir(), "testschema.db")
+	db, err := openDatabase(dbfile)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer db.Close()
+	err = migrateDatabase(db)
+	if err != nil {
+		t.Error(err.Error())
+	}
+	err = migrateDatabase(nil)
+	if err == nil {
+		t.Error("nil database not detected")
+	}
+}
+
+// content of delivered messages is dropped
+func Test_openDatabase_4(t *testing.T) {
+	t.Parallel()
+	dbfile := createTestDatabase(t, 5,
+		"INSERT INTO messages (target, source, content, delivered) VALUES ('testuser', 'alice', 'delivered message', 1)",
+		"INSERT INTO messages (target, source, content) VALUES ('testuser', 'alice', 'pending message')")
+	db, err := openDatabase(dbfile)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer db.Close()
+	contents := []string{}
+	rows, err := db.Query("SELECT content FROM messages ORDER BY id")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer rows.Close()
+	for rows.Next() {
+		content := ""
+		rows.Scan(&content)
+		contents = append(contents, content)
+	}
+	if 2 != len(contents) || "" != contents[0] || "pending message" != contents[1] {
+		t.Error("wrong content after migration")
+	}
+}
+
+// message ids survive the migration, are never reused and VACUUM
+func Test_openDatabase_5(t *testing.T) {
+	t.Parallel()
+	dbfile := createTestDatabase(t, 7,
+		"INSERT INTO messages (target, source, content) VALUES ('bob', 'alice', 'first')",
+		"INSERT INTO messages (target, source, content) VALUES ('bob', 'alice', 'second')",
+		"INSERT INTO messages (target, source, content) VALUES ('bob', 'alice', 'third')",
+		"DELETE FROM messages WHERE rowid = 2")
+	db, err := openDatabase(dbfile)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer db.Close()
+	statements := []string{
+		"DELETE FROM messages WHERE id = 3",
+		"INSERT INTO messages (target, source, content) VALUES ('bob', 'alice', 'fourth')",
+		"VACUUM",
+	}
+	for _, statement := range statements {
+		if _, err = db.Exec(statement); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	rows, err := db.Query("SELECT id, content FROM messages ORDER BY id")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer rows.Close()
+	ids := []string{}
+	for rows.Next() {
+		id, content := 0, ""
+		rows.Scan(&id, &content)
+		ids = append(ids, fmt.Sprintf("%d:%s", id, content))
+	}
+	if "1:first 4:fourth" != strings.Join(ids, " ") {
+		t.Error("wrong ids: " + strings.Join(ids, " "))
+	}
+}
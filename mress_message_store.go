@@ -0,0 +1,68 @@
+package main
+
+import (
+	"time"
+)
+
+// A message stored for delivery to an offline user.
+type offlineMessage struct {
+	id        int64 // unique id assigned by the store
+	target    string
+	targetKey string // target folded according to the casemapping
+	source    string
+	sourceKey string // source folded according to the casemapping
+	content   string
+	keyID     string // key the content is encrypted with, empty for plain text
+	created   time.Time
+	context   string    // channel the message was left in, empty for direct messages
+	delivered time.Time // zero until delivered
+	public    bool      // deliver in the channel it was left in (ptell)
+	notice    bool      // expiry notification from mress, see expire()
+}
+
+// Storage of offline messages. Implementations have to be safe for
+// concurrent use.
+type messageStore interface {
+	// Store a message. The id of the message is set on success. If
+	// seal is not nil, it is applied to a copy of the message once its
+	// id is known (e.g. to encrypt the content with the id as additional
+	// data) and the sealed copy is stored instead, atomically.
+	save(msg *offlineMessage, seal func(msg *offlineMessage) error) error
+	// List all undelivered messages for a (folded) target, oldest first.
+	pending(targetKey string) ([]offlineMessage, error)
+	// Retrieve all undelivered messages for a (folded) target and mark
+	// them as delivered at the given time, atomically. Only the metadata
+	// of delivered messages is kept, their content is dropped. If open
+	// is not nil, it is applied to every message before (e.g. to
+	// decrypt it), messages it fails for stay undelivered and are left
+	// out. Reporting these failures is up to open.
+	takePending(targetKey string, now time.Time, open func(msg *offlineMessage) error) ([]offlineMessage, error)
+	// Mark undelivered messages of a (folded) target as delivered,
+	// dropping their content. Returns the number of messages marked.
+	markDelivered(targetKey string, ids []int64, now time.Time) (int, error)
+	// Remove undelivered messages of a (folded) target.
+	// Returns the number of messages removed.
+	remove(targetKey string, ids []int64) (int, error)
+	// List all undelivered messages of a (folded) source, oldest first.
+	outgoing(sourceKey string) ([]offlineMessage, error)
+	// Remove undelivered messages of a (folded) source.
+	// Returns the number of messages removed.
+	retract(sourceKey string, ids []int64) (int, error)
+	// List all messages (delivered or not) of a (folded) nick as
+	// target or source, oldest first.
+	about(key string) ([]offlineMessage, error)
+	// Remove all messages (delivered or not) of a (folded) nick as
+	// target or source. Returns the number of messages removed.
+	forget(key string) (int, error)
+	// Count all undelivered messages, of all networks if they share
+	// the storage.
+	countPending() (int, error)
+	// Remove all messages (delivered or not) created before the given
+	// time. Returns the removed messages which were not delivered.
+	expire(before time.Time) ([]offlineMessage, error)
+	// Recompute the folded target and source of all messages,
+	// e.g. after the casemapping changed.
+	rekey(fold func(nick string) string) error
+	// Release resources held by the store.
+	close() error
+}
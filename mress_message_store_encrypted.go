@@ -0,0 +1,223 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+)
+
+// Encrypts the content of messages before they are handed to another
+// store and decrypts it on the way back. Targets and sources stay in
+// plain text as they are needed for lookups, but are authenticated
+// with the content together with the id, so encrypted content can't
+// be moved to another message. Messages which can't be
+// decrypted are logged and left out, they stay in the wrapped store.
+// Implements messageStore.
+type encryptedMessageStore struct {
+	store  messageStore
+	keys   *keyring
+	logger *log.Logger
+}
+
+// Wrap store to keep message content encrypted with keys.
+func newEncryptedMessageStore(store messageStore, keys *keyring, logger *log.Logger) (*encryptedMessageStore, error) {
+	if store == nil {
+		return nil, fmt.Errorf("message store is nil")
+	}
+	if !keys.enabled() {
+		return nil, fmt.Errorf("no encryption key")
+	}
+	if logger == nil {
+		return nil, fmt.Errorf("logger nil pointer")
+	}
+	return &encryptedMessageStore{store: store, keys: keys, logger: logger}, nil
+}
+
+// Data authenticated along with the content of a message. The id is the
+// primary key of the message (see migration 8), unlike the rowid it
+// survives VACUUM.
+func additionalData(id int64, target, source string) []byte {
+	return []byte(strconv.FormatInt(id, 10) + "\x00" + target + "\x00" + source)
+}
+
+// Store a message with encrypted content (sealed by seal before if it
+// is not nil). The id of the message is set on success, the content
+// stays as it is.
+func (s *encryptedMessageStore) save(msg *offlineMessage, seal func(msg *offlineMessage) error) error {
+	return s.store.save(msg, func(msg *offlineMessage) error {
+		if seal != nil {
+			err := seal(msg)
+			if err != nil {
+				return err
+			}
+		}
+		var err error
+		msg.keyID, msg.content, err = s.keys.encrypt(msg.content, additionalData(msg.id, msg.target, msg.source))
+		return err
+	})
+}
+
+// Decrypt the content of a message in place, logs failures. Content
+// stored before encryption was enabled is plain text already.
+func (s *encryptedMessageStore) open(msg *offlineMessage) error {
+	if 0 == len(msg.keyID) {
+		return nil
+	}
+	content, err := s.keys.decrypt(msg.keyID, msg.content, additionalData(msg.id, msg.target, msg.source))
+	if err != nil {
+		s.logger.Println("skipping message " + strconv.FormatInt(msg.id, 10) + ", decrypting failed: " + err.Error())
+		return err
+	}
+	msg.content = content
+	msg.keyID = ""
+	return nil
+}
+
+// Decrypt the content of messages, leave out the ones failing.
+func (s *encryptedMessageStore) decrypt(messages []offlineMessage, err error) ([]offlineMessage, error) {
+	if err != nil {
+		return nil, err
+	}
+	return openMessages(messages, s.open), nil
+}
+
+// List all undelivered messages for a (folded) target, decrypted.
+func (s *encryptedMessageStore) pending(targetKey string) ([]offlineMessage, error) {
+	return s.decrypt(s.store.pending(targetKey))
+}
+
+// Retrieve undelivered messages for a (folded) target, decrypted,
+// and mark them as delivered. Decrypting happens before, messages
+// failing stay undelivered.
+func (s *encryptedMessageStore) takePending(targetKey string, now time.Time, open func(msg *offlineMessage) error) ([]offlineMessage, error) {
+	return s.store.takePending(targetKey, now, func(msg *offlineMessage) error {
+		err := s.open(msg)
+		if err == nil && open != nil {
+			err = open(msg)
+		}
+		return err
+	})
+}
+
+// Mark undelivered messages of a (folded) target as delivered.
+func (s *encryptedMessageStore) markDelivered(targetKey string, ids []int64, now time.Time) (int, error) {
+	return s.store.markDelivered(targetKey, ids, now)
+}
+
+// Remove undelivered messages of a (folded) target.
+func (s *encryptedMessageStore) remove(targetKey string, ids []int64) (int, error) {
+	return s.store.remove(targetKey, ids)
+}
+
+// List all undelivered messages of a (folded) source, decrypted.
+func (s *encryptedMessageStore) outgoing(sourceKey string) ([]offlineMessage, error) {
+	return s.decrypt(s.store.outgoing(sourceKey))
+}
+
+// Remove undelivered messages of a (folded) source.
+func (s *encryptedMessageStore) retract(sourceKey string, ids []int64) (int, error) {
+	return s.store.retract(sourceKey, ids)
+}
+
+// List all messages of a (folded) nick as target or source, decrypted.
+func (s *encryptedMessageStore) about(key string) ([]offlineMessage, error) {
+	return s.decrypt(s.store.about(key))
+}
+
+// Remove all messages of a (folded) nick as target or source.
+func (s *encryptedMessageStore) forget(key string) (int, error) {
+	return s.store.forget(key)
+}
+
+// Count all undelivered messages.
+func (s *encryptedMessageStore) countPending() (int, error) {
+	return s.store.countPending()
+}
+
+// Remove messages created before the given time. Returns the
+// removed undelivered messages, decrypted.
+func (s *encryptedMessageStore) expire(before time.Time) ([]offlineMessage, error) {
+	return s.decrypt(s.store.expire(before))
+}
+
+// Recompute the folded target and source of all messages.
+func (s *encryptedMessageStore) rekey(fold func(nick string) string) error {
+	return s.store.rekey(fold)
+}
+
+// Release resources held by the wrapped store.
+func (s *encryptedMessageStore) close() error {
+	return s.store.close()
+}
+
+// Encrypt the content of all undelivered messages in the database
+// with the current key, e.g. after adding a new key or enabling
+// encryption for an existing database (delivered messages have no
+// content). Content already encrypted with the current key is left
+// alone. Returns the number of messages rewritten.
+func reencryptDatabase(db *sql.DB, keys *keyring) (int, error) {
+	if db == nil {
+		return 0, fmt.Errorf("database pointer is nil")
+	}
+	if !keys.enabled() {
+		return 0, fmt.Errorf("no encryption key")
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, fmt.Errorf("beginning transaction failed: %v", err)
+	}
+	defer tx.Rollback()
+
+	type row struct {
+		id             int64
+		target, source string
+		content, key   string
+	}
+	rows, err := tx.Query("SELECT id, target, source, content, content_key FROM messages WHERE delivered IS NULL")
+	if err != nil {
+		return 0, fmt.Errorf("query failed: %v", err)
+	}
+	stale := []row{}
+	for rows.Next() {
+		var r row
+		err = rows.Scan(&r.id, &r.target, &r.source, &r.content, &r.key)
+		if err != nil {
+			rows.Close()
+			return 0, fmt.Errorf("reading message failed: %v", err)
+		}
+		if r.key == keys.current {
+			continue
+		}
+		stale = append(stale, r)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return 0, fmt.Errorf("reading messages failed: %v", err)
+	}
+
+	for _, r := range stale {
+		data := additionalData(r.id, r.target, r.source)
+		plain := r.content
+		if 0 < len(r.key) {
+			plain, err = keys.decrypt(r.key, r.content, data)
+			if err != nil {
+				return 0, fmt.Errorf("message %d: %v", r.id, err)
+			}
+		}
+		id, content, err := keys.encrypt(plain, data)
+		if err != nil {
+			return 0, err
+		}
+		_, err = tx.Exec("UPDATE messages SET content = ?, content_key = ? WHERE id = ?", content, id, r.id)
+		if err != nil {
+			return 0, fmt.Errorf("executing UPDATE failed: %v", err)
+		}
+	}
+	err = tx.Commit()
+	if err != nil {
+		return 0, fmt.Errorf("commiting to database failed: %v", err)
+	}
+	return len(stale), nil
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Storage of offline messages in memory, nothing is persisted.
+// Meant for tests. Implements messageStore.
+type memoryMessageStore struct {
+	mutex    sync.Mutex
+	lastID   int64
+	messages []offlineMessage
+}
+
+// Create an empty in-memory message store.
+func newMemoryMessageStore() *memoryMessageStore {
+	return &memoryMessageStore{}
+}
+
+// Nothing to release.
+func (s *memoryMessageStore) close() error {
+	return nil
+}
+
+// Store a message, sealed if seal is not nil. The id of the message
+// is set on success.
+func (s *memoryMessageStore) save(msg *offlineMessage, seal func(msg *offlineMessage) error) error {
+	if msg == nil {
+		return fmt.Errorf("message pointer is nil")
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	stored := *msg
+	stored.id = s.lastID + 1
+	if seal != nil {
+		err := seal(&stored)
+		if err != nil {
+			return err
+		}
+	}
+	s.lastID = stored.id
+	msg.id = stored.id
+	s.messages = append(s.messages, stored)
+	return nil
+}
+
+// Retrieve all undelivered messages for a (folded) target and mark
+// exactly these as delivered at the given time, dropping their content.
+// Messages open fails for are left alone.
+func (s *memoryMessageStore) takePending(targetKey string, now time.Time, open func(msg *offlineMessage) error) ([]offlineMessage, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	messages := []offlineMessage{}
+	for i := range s.messages {
+		if targetKey != s.messages[i].targetKey || !s.messages[i].delivered.IsZero() {
+			continue
+		}
+		msg := s.messages[i]
+		if open != nil && nil != open(&msg) {
+			continue
+		}
+		msg.delivered = now
+		messages = append(messages, msg)
+		s.messages[i].delivered = now
+		s.messages[i].content = ""
+		s.messages[i].keyID = ""
+	}
+	return messages, nil
+}
+
+// List all undelivered messages for a (folded) target, oldest first.
+func (s *memoryMessageStore) pending(targetKey string) ([]offlineMessage, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	messages := []offlineMessage{}
+	for _, msg := range s.messages {
+		if targetKey == msg.targetKey && msg.delivered.IsZero() {
+			messages = append(messages, msg)
+		}
+	}
+	return messages, nil
+}
+
+// Mark undelivered messages of a (folded) target as delivered,
+// dropping their content.
+func (s *memoryMessageStore) markDelivered(targetKey string, ids []int64, now time.Time) (int, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	marked := 0
+	for i := range s.messages {
+		msg := &s.messages[i]
+		if targetKey == msg.targetKey && msg.delivered.IsZero() && containsID(ids, msg.id) {
+			msg.delivered = now
+			msg.content = ""
+			msg.keyID = ""
+			marked++
+		}
+	}
+	return marked, nil
+}
+
+// Remove undelivered messages of a (folded) target.
+func (s *memoryMessageStore) remove(targetKey string, ids []int64) (int, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	kept := s.messages[:0]
+	for _, msg := range s.messages {
+		if targetKey == msg.targetKey && msg.delivered.IsZero() && containsID(ids, msg.id) {
+			continue
+		}
+		kept = append(kept, msg)
+	}
+	removed := len(s.messages) - len(kept)
+	s.messages = kept
+	return removed, nil
+}
+
+// List all undelivered messages of a (folded) source, oldest first.
+func (s *memoryMessageStore) outgoing(sourceKey string) ([]offlineMessage, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	messages := []offlineMessage{}
+	for _, msg := range s.messages {
+		if sourceKey == msg.sourceKey && msg.delivered.IsZero() {
+			messages = append(messages, msg)
+		}
+	}
+	return messages, nil
+}
+
+// Remove undelivered messages of a (folded) source.
+func (s *memoryMessageStore) retract(sourceKey string, ids []int64) (int, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	kept := s.messages[:0]
+	for _, msg := range s.messages {
+		if sourceKey == msg.sourceKey && msg.delivered.IsZero() && containsID(ids, msg.id) {
+			continue
+		}
+		kept = append(kept, msg)
+	}
+	removed := len(s.messages) - len(kept)
+	s.messages = kept
+	return removed, nil
+}
+
+// List all messages (delivered or not) of a (folded) nick as target
+// or source, oldest first.
+func (s *memoryMessageStore) about(key string) ([]offlineMessage, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	messages := []offlineMessage{}
+	for _, msg := range s.messages {
+		if key == msg.targetKey || key == msg.sourceKey {
+			messages = append(messages, msg)
+		}
+	}
+	return messages, nil
+}
+
+// Remove all messages (delivered or not) of a (folded) nick as target
+// or source.
+func (s *memoryMessageStore) forget(key string) (int, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	kept := s.messages[:0]
+	for _, msg := range s.messages {
+		if key != msg.targetKey && key != msg.sourceKey {
+			kept = append(kept, msg)
+		}
+	}
+	removed := len(s.messages) - len(kept)
+	s.messages = kept
+	return removed, nil
+}
+
+// Count all undelivered messages.
+func (s *memoryMessageStore) countPending() (int, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	count := 0
+	for _, msg := range s.messages {
+		if msg.delivered.IsZero() {
+			count++
+		}
+	}
+	return count, nil
+}
+
+// Remove all messages created before the given time. Returns the
+// removed messages which were not delivered.
+func (s *memoryMessageStore) expire(before time.Time) ([]offlineMessage, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	expired := []offlineMessage{}
+	kept := s.messages[:0]
+	for _, msg := range s.messages {
+		if !msg.created.Before(before) {
+			kept = append(kept, msg)
+			continue
+		}
+		if msg.delivered.IsZero() {
+			expired = append(expired, msg)
+		}
+	}
+	s.messages = kept
+	return expired, nil
+}
+
+// Report if id is one of ids.
+func containsID(ids []int64, id int64) bool {
+	for _, i := range ids {
+		if id == i {
+			return true
+		}
+	}
+	return false
+}
+
+// Recompute the folded target and source of all messages.
+func (s *memoryMessageStore) rekey(fold func(nick string) string) error {
+	if fold == nil {
+		return fmt.Errorf("fold function is nil")
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for i := range s.messages {
+		s.messages[i].targetKey = fold(s.messages[i].target)
+		s.messages[i].sourceKey = fold(s.messages[i].source)
+	}
+	return nil
+}
@@ -0,0 +1,424 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// Long-lived storage of offline messages in the sqlite database.
+// Created once per network and shared, statements are prepared up
+// front. Every store only sees the messages of its network, except
+// for countPending().
+// Implements messageStore.
+type sqliteMessageStore struct {
+	db          *sql.DB
+	network     string
+	insert      *sql.Stmt
+	sealMsg     *sql.Stmt
+	selPending  *sql.Stmt
+	markDeliver *sql.Stmt
+	removeMsg   *sql.Stmt
+	selOutgoing *sql.Stmt
+	retractMsg  *sql.Stmt
+	selExpired  *sql.Stmt
+	expireMsg   *sql.Stmt
+	cntPending  *sql.Stmt
+	selAbout    *sql.Stmt
+	forgetMsg   *sql.Stmt
+}
+
+// Create a sqlite message store for the messages of a network using an
+// opened (and migrated) database. See also openDatabase()
+func newSQLiteMessageStore(db *sql.DB, network string) (*sqliteMessageStore, error) {
+	if db == nil {
+		return nil, fmt.Errorf("database pointer is nil")
+	}
+	if len(network) == 0 {
+		return nil, fmt.Errorf("network name of zero-length")
+	}
+	store := &sqliteMessageStore{db: db, network: network}
+	statements := []struct {
+		stmt **sql.Stmt
+		sql  string
+	}{
+		{&store.insert, "INSERT INTO messages (network, target, target_key, source, source_key, content, content_key, created, context, public, notice) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)"},
+		{&store.sealMsg, "UPDATE messages SET content = ?, content_key = ? WHERE network = ? AND id = ?"},
+		{&store.selPending, "SELECT id, target, target_key, source, source_key, content, content_key, created, context, delivered, public, notice FROM messages WHERE network = ? AND target_key = ? AND delivered IS NULL ORDER BY id"},
+		{&store.markDeliver, "UPDATE messages SET delivered = ?, content = '', content_key = '' WHERE network = ? AND target_key = ? AND id = ? AND delivered IS NULL"},
+		{&store.removeMsg, "DELETE FROM messages WHERE network = ? AND target_key = ? AND id = ? AND delivered IS NULL"},
+		{&store.selOutgoing, "SELECT id, target, target_key, source, source_key, content, content_key, created, context, delivered, public, notice FROM messages WHERE network = ? AND source_key = ? AND delivered IS NULL ORDER BY id"},
+		{&store.retractMsg, "DELETE FROM messages WHERE network = ? AND source_key = ? AND id = ? AND delivered IS NULL"},
+		{&store.selExpired, "SELECT id, target, target_key, source, source_key, content, content_key, created, context, delivered, public, notice FROM messages WHERE network = ? AND created < ? AND delivered IS NULL ORDER BY id"},
+		{&store.expireMsg, "DELETE FROM messages WHERE network = ? AND created < ?"},
+		{&store.cntPending, "SELECT COUNT(*) FROM messages WHERE delivered IS NULL"},
+		{&store.selAbout, "SELECT id, target, target_key, source, source_key, content, content_key, created, context, delivered, public, notice FROM messages WHERE network = ? AND (target_key = ? OR source_key = ?) ORDER BY id"},
+		{&store.forgetMsg, "DELETE FROM messages WHERE network = ? AND (target_key = ? OR source_key = ?)"},
+	}
+	for _, s := range statements {
+		stmt, err := db.Prepare(s.sql)
+		if err != nil {
+			store.close()
+			return nil, fmt.Errorf("preparing statement failed: %v", err)
+		}
+		*s.stmt = stmt
+	}
+	return store, nil
+}
+
+// Release the prepared statements. The database stays open.
+func (s *sqliteMessageStore) close() error {
+	for _, stmt := range []*sql.Stmt{s.insert, s.sealMsg, s.selPending, s.markDeliver, s.removeMsg, s.selOutgoing, s.retractMsg, s.selExpired, s.expireMsg, s.cntPending, s.selAbout, s.forgetMsg} {
+		if stmt != nil {
+			stmt.Close()
+		}
+	}
+	return nil
+}
+
+// Store a message, sealed if seal is not nil. The id of the message
+// is set on success. A sealed message is inserted without content, the
+// sealed content is written in the same transaction once the id is
+// known, so the unsealed content never reaches the database.
+func (s *sqliteMessageStore) save(msg *offlineMessage, seal func(msg *offlineMessage) error) error {
+	if msg == nil {
+		return fmt.Errorf("message pointer is nil")
+	}
+	tx, err := s.db.Begin()
+	if err != nil {
+		return fmt.Errorf("beginning transaction failed: %v", err)
+	}
+	defer tx.Rollback()
+	content := msg.content
+	if seal != nil {
+		content = ""
+	}
+	result, err := tx.Stmt(s.insert).Exec(s.network, msg.target, msg.targetKey, msg.source, msg.sourceKey, content, msg.keyID, msg.created.Unix(), msg.context, msg.public, msg.notice)
+	if err != nil {
+		return fmt.Errorf("executing INSERT failed: %v", err)
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return fmt.Errorf("reading message id failed: %v", err)
+	}
+	if seal != nil {
+		sealed := *msg
+		sealed.id = id
+		err = seal(&sealed)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Stmt(s.sealMsg).Exec(sealed.content, sealed.keyID, s.network, id)
+		if err != nil {
+			return fmt.Errorf("executing UPDATE failed: %v", err)
+		}
+	}
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("commiting to database failed: %v", err)
+	}
+	msg.id = id
+	return nil
+}
+
+// Retrieve all undelivered messages for a (folded) target and mark
+// exactly these rows as delivered at the given time, dropping their
+// content. Both happens in one transaction, so messages are neither
+// handed out twice nor lost. Messages open fails for are left alone.
+func (s *sqliteMessageStore) takePending(targetKey string, now time.Time, open func(msg *offlineMessage) error) ([]offlineMessage, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("beginning transaction failed: %v", err)
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Stmt(s.selPending).Query(s.network, targetKey)
+	if err != nil {
+		return nil, fmt.Errorf("query failed: %v", err)
+	}
+	messages, err := scanMessages(rows)
+	if err != nil {
+		return nil, err
+	}
+	messages = openMessages(messages, open)
+	if len(messages) == 0 {
+		return messages, nil
+	}
+
+	// mark exactly the retrieved messages as delivered
+	stmt := tx.Stmt(s.markDeliver)
+	for i := range messages {
+		_, err = stmt.Exec(now.Unix(), s.network, targetKey, messages[i].id)
+		if err != nil {
+			return nil, fmt.Errorf("executing UPDATE failed: %v", err)
+		}
+		messages[i].delivered = now
+	}
+	err = tx.Commit()
+	if err != nil {
+		return nil, fmt.Errorf("commiting to database failed: %v", err)
+	}
+	return messages, nil
+}
+
+// List all undelivered messages for a (folded) target, oldest first.
+func (s *sqliteMessageStore) pending(targetKey string) ([]offlineMessage, error) {
+	rows, err := s.selPending.Query(s.network, targetKey)
+	if err != nil {
+		return nil, fmt.Errorf("query failed: %v", err)
+	}
+	return scanMessages(rows)
+}
+
+// Mark undelivered messages of a (folded) target as delivered,
+// dropping their content.
+func (s *sqliteMessageStore) markDelivered(targetKey string, ids []int64, now time.Time) (int, error) {
+	return s.execForIDs(s.markDeliver, ids, now.Unix(), s.network, targetKey)
+}
+
+// Remove undelivered messages of a (folded) target.
+func (s *sqliteMessageStore) remove(targetKey string, ids []int64) (int, error) {
+	return s.execForIDs(s.removeMsg, ids, s.network, targetKey)
+}
+
+// List all undelivered messages of a (folded) source, oldest first.
+func (s *sqliteMessageStore) outgoing(sourceKey string) ([]offlineMessage, error) {
+	rows, err := s.selOutgoing.Query(s.network, sourceKey)
+	if err != nil {
+		return nil, fmt.Errorf("query failed: %v", err)
+	}
+	return scanMessages(rows)
+}
+
+// Remove undelivered messages of a (folded) source.
+func (s *sqliteMessageStore) retract(sourceKey string, ids []int64) (int, error) {
+	return s.execForIDs(s.retractMsg, ids, s.network, sourceKey)
+}
+
+// List all messages (delivered or not) of a (folded) nick as target
+// or source, oldest first.
+func (s *sqliteMessageStore) about(key string) ([]offlineMessage, error) {
+	rows, err := s.selAbout.Query(s.network, key, key)
+	if err != nil {
+		return nil, fmt.Errorf("query failed: %v", err)
+	}
+	return scanMessages(rows)
+}
+
+// Remove all messages (delivered or not) of a (folded) nick as target
+// or source. Returns the number of messages removed.
+func (s *sqliteMessageStore) forget(key string) (int, error) {
+	result, err := s.forgetMsg.Exec(s.network, key, key)
+	if err != nil {
+		return 0, fmt.Errorf("executing DELETE failed: %v", err)
+	}
+	removed, err := result.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("reading number of removed messages failed: %v", err)
+	}
+	return int(removed), nil
+}
+
+// Count all undelivered messages of all networks in the database,
+// the quota on them is shared.
+func (s *sqliteMessageStore) countPending() (int, error) {
+	count := 0
+	err := s.cntPending.QueryRow().Scan(&count)
+	if err != nil {
+		return 0, fmt.Errorf("counting messages failed: %v", err)
+	}
+	return count, nil
+}
+
+// Remove all messages created before the given time. Returns the
+// removed messages which were not delivered.
+func (s *sqliteMessageStore) expire(before time.Time) ([]offlineMessage, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("beginning transaction failed: %v", err)
+	}
+	defer tx.Rollback()
+	rows, err := tx.Stmt(s.selExpired).Query(s.network, before.Unix())
+	if err != nil {
+		return nil, fmt.Errorf("query failed: %v", err)
+	}
+	expired, err := scanMessages(rows)
+	if err != nil {
+		return nil, err
+	}
+	_, err = tx.Stmt(s.expireMsg).Exec(s.network, before.Unix())
+	if err != nil {
+		return nil, fmt.Errorf("executing DELETE failed: %v", err)
+	}
+	err = tx.Commit()
+	if err != nil {
+		return nil, fmt.Errorf("commiting to database failed: %v", err)
+	}
+	return expired, nil
+}
+
+// Execute stmt with (args..., id) for every id in one transaction.
+// Returns the number of rows affected.
+func (s *sqliteMessageStore) execForIDs(stmt *sql.Stmt, ids []int64, args ...interface{}) (int, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return 0, fmt.Errorf("beginning transaction failed: %v", err)
+	}
+	defer tx.Rollback()
+	txStmt := tx.Stmt(stmt)
+	affected := int64(0)
+	for _, id := range ids {
+		params := append(append([]interface{}{}, args...), id)
+		result, err := txStmt.Exec(params...)
+		if err != nil {
+			return 0, fmt.Errorf("executing statement failed: %v", err)
+		}
+		n, err := result.RowsAffected()
+		if err != nil {
+			return 0, fmt.Errorf("reading affected rows failed: %v", err)
+		}
+		affected += n
+	}
+	err = tx.Commit()
+	if err != nil {
+		return 0, fmt.Errorf("commiting to database failed: %v", err)
+	}
+	return int(affected), nil
+}
+
+// Recompute the folded target and source of all messages.
+func (s *sqliteMessageStore) rekey(fold func(nick string) string) error {
+	if fold == nil {
+		return fmt.Errorf("fold function is nil")
+	}
+	tx, err := s.db.Begin()
+	if err != nil {
+		return fmt.Errorf("beginning transaction failed: %v", err)
+	}
+	defer tx.Rollback()
+	err = rekeyMessages(tx, fold, s.network)
+	if err != nil {
+		return err
+	}
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("commiting to database failed: %v", err)
+	}
+	return nil
+}
+
+// Move all messages (delivered or not) of a network to another one.
+// Returns the number of messages moved.
+func moveMessages(db *sql.DB, from, to string) (int, error) {
+	if db == nil {
+		return 0, fmt.Errorf("database pointer is nil")
+	}
+	result, err := db.Exec("UPDATE messages SET network = ? WHERE network = ?", to, from)
+	if err != nil {
+		return 0, fmt.Errorf("executing UPDATE failed: %v", err)
+	}
+	moved, err := result.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("reading number of moved messages failed: %v", err)
+	}
+	return int(moved), nil
+}
+
+// Count all messages (delivered or not) of a network.
+func countMessages(db *sql.DB, network string) (int, error) {
+	if db == nil {
+		return 0, fmt.Errorf("database pointer is nil")
+	}
+	count := 0
+	err := db.QueryRow("SELECT COUNT(*) FROM messages WHERE network = ?", network).Scan(&count)
+	if err != nil {
+		return 0, fmt.Errorf("counting messages failed: %v", err)
+	}
+	return count, nil
+}
+
+// Recompute target_key and source_key of the messages of a network,
+// all messages if network is empty. Used by the store and by migrations
+// (so by rowid, the id column is an alias of it since migration 8).
+func rekeyMessages(tx *sql.Tx, fold func(nick string) string, network string) error {
+	query := "SELECT rowid, target, source FROM messages"
+	args := []interface{}{}
+	if 0 < len(network) {
+		query += " WHERE network = ?"
+		args = append(args, network)
+	}
+	rows, err := tx.Query(query, args...)
+	if err != nil {
+		return fmt.Errorf("query failed: %v", err)
+	}
+	type nicks struct {
+		id             int64
+		target, source string
+	}
+	all := []nicks{}
+	for rows.Next() {
+		n := nicks{}
+		err = rows.Scan(&n.id, &n.target, &n.source)
+		if err != nil {
+			rows.Close()
+			return fmt.Errorf("reading message failed: %v", err)
+		}
+		all = append(all, n)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return fmt.Errorf("reading messages failed: %v", err)
+	}
+	stmt, err := tx.Prepare("UPDATE messages SET target_key = ?, source_key = ? WHERE rowid = ?")
+	if err != nil {
+		return fmt.Errorf("preparing UPDATE failed: %v", err)
+	}
+	defer stmt.Close()
+	for _, n := range all {
+		_, err = stmt.Exec(fold(n.target), fold(n.source), n.id)
+		if err != nil {
+			return fmt.Errorf("executing UPDATE failed: %v", err)
+		}
+	}
+	return nil
+}
+
+// Apply open to all messages, keep the ones it succeeds for.
+func openMessages(messages []offlineMessage, open func(msg *offlineMessage) error) []offlineMessage {
+	if open == nil {
+		return messages
+	}
+	opened := messages[:0]
+	for _, msg := range messages {
+		if err := open(&msg); err == nil {
+			opened = append(opened, msg)
+		}
+	}
+	return opened
+}
+
+// Read messages from rows of (id, target, target_key, source,
+// source_key, content, content_key, created, context, delivered, public,
+// notice) and close the rows.
+func scanMessages(rows *sql.Rows) ([]offlineMessage, error) {
+	defer rows.Close()
+	messages := []offlineMessage{}
+	for rows.Next() {
+		msg := offlineMessage{}
+		created := int64(0)
+		delivered := sql.NullInt64{}
+		err := rows.Scan(&msg.id, &msg.target, &msg.targetKey, &msg.source, &msg.sourceKey, &msg.content, &msg.keyID, &created, &msg.context, &delivered, &msg.public, &msg.notice)
+		if err != nil {
+			return nil, fmt.Errorf("reading message failed: %v", err)
+		}
+		msg.created = time.Unix(created, 0)
+		if delivered.Valid {
+			msg.delivered = time.Unix(delivered.Int64, 0)
+		}
+		messages = append(messages, msg)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("reading messages failed: %v", err)
+	}
+	return messages, nil
+}
@@ -0,0 +1,549 @@
+package main
+
+import (
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// open a fresh sqlite message store in a temporary directory
+func openTestStore(t *testing.T) *sqliteMessageStore {
+	db, err := openDatabase(filepath.Join(t.TempDir(), "teststore.db"))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	store, err := newSQLiteMessageStore(db, defaultNetwork)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	t.Cleanup(func() {
+		store.close()
+		db.Close()
+	})
+	return store
+}
+
+// store a message the way the offline messenger does
+func saveTestMessage(store messageStore, nicks *nickMapper, source, target, context, content string) error {
+	msg := &offlineMessage{
+		target:    target,
+		targetKey: nicks.fold(target),
+		source:    source,
+		sourceKey: nicks.fold(source),
+		content:   content,
+		created:   time.Now(),
+		context:   context,
+	}
+	return store.save(msg, nil)
+}
+
+// all message store implementations, fresh and empty
+func testStores(t *testing.T) map[string]messageStore {
+	return map[string]messageStore{
+		"sqlite": openTestStore(t),
+		"memory": newMemoryMessageStore(),
+	}
+}
+
+func Test_newSQLiteMessageStore_0(t *testing.T) {
+	t.Parallel()
+	_, err := newSQLiteMessageStore(nil, defaultNetwork)
+	if err == nil {
+		t.Error("nil database not detected")
+	}
+}
+
+// messages of all senders are handed out exactly once
+func Test_messageStore_takePending_0(t *testing.T) {
+	t.Parallel()
+	for name, store := range testStores(t) {
+		saveTestMessage(store, nil, "alice", "testuser", "", "first")
+		saveTestMessage(store, nil, "bob", "testuser", "", "second")
+		saveTestMessage(store, nil, "alice", "testuser", "", "third")
+		saveTestMessage(store, nil, "alice", "otheruser", "", "not yours")
+
+		messages, err := store.takePending("testuser", time.Now(), nil)
+		if err != nil {
+			t.Fatal(name + ": " + err.Error())
+		}
+		if 3 != len(messages) {
+			t.Fatal(name + ": wrong number of messages retrieved")
+		}
+		if "first" != messages[0].content || "second" != messages[1].content || "third" != messages[2].content {
+			t.Error(name + ": messages retrieved in wrong order")
+		}
+		if "bob" != messages[1].source {
+			t.Error(name + ": wrong source retrieved")
+		}
+
+		messages, err = store.takePending("testuser", time.Now(), nil)
+		if err != nil {
+			t.Fatal(name + ": " + err.Error())
+		}
+		if 0 != len(messages) {
+			t.Error(name + ": messages handed out twice")
+		}
+		messages, err = store.takePending("otheruser", time.Now(), nil)
+		if err != nil {
+			t.Fatal(name + ": " + err.Error())
+		}
+		if 1 != len(messages) {
+			t.Error(name + ": message for other user got lost")
+		}
+	}
+}
+
+// context and timestamps are kept
+func Test_messageStore_takePending_1(t *testing.T) {
+	t.Parallel()
+	for name, store := range testStores(t) {
+		before := time.Now().Add(-time.Second)
+		saveTestMessage(store, nil, "alice", "testuser", "#foo", "hello")
+		messages, err := store.takePending("testuser", time.Now(), nil)
+		if err != nil {
+			t.Fatal(name + ": " + err.Error())
+		}
+		if 1 != len(messages) {
+			t.Fatal(name + ": wrong number of messages retrieved")
+		}
+		if "#foo" != messages[0].context {
+			t.Error(name + ": wrong context (" + messages[0].context + ")")
+		}
+		if messages[0].created.Before(before) {
+			t.Error(name + ": wrong creation time")
+		}
+		if messages[0].delivered.Before(messages[0].created) {
+			t.Error(name + ": wrong delivery time")
+		}
+	}
+}
+
+func Test_messageStore_save_0(t *testing.T) {
+	t.Parallel()
+	for name, store := range testStores(t) {
+		err := store.save(nil, nil)
+		if err == nil {
+			t.Error(name + ": nil message not detected")
+		}
+		msg := &offlineMessage{target: "testuser", source: "alice", content: "hello", created: time.Now()}
+		err = store.save(msg, nil)
+		if err != nil {
+			t.Fatal(name + ": " + err.Error())
+		}
+		if 0 == msg.id {
+			t.Error(name + ": message id not set")
+		}
+	}
+}
+
+// lookup by folded nick, rekeying after a change of the casemapping
+func Test_messageStore_rekey_0(t *testing.T) {
+	t.Parallel()
+	for name, store := range testStores(t) {
+		nicks := newNickMapper()
+		saveTestMessage(store, nicks, "alice", "Bob[m]", "", "hello")
+		err := store.rekey(asciiMapping.fold)
+		if err != nil {
+			t.Fatal(name + ": " + err.Error())
+		}
+		messages, err := store.takePending(asciiMapping.fold("BOB{M}"), time.Now(), nil)
+		if err != nil {
+			t.Fatal(name + ": " + err.Error())
+		}
+		if 0 != len(messages) {
+			t.Error(name + ": message not rekeyed")
+		}
+		messages, err = store.takePending(asciiMapping.fold("BOB[M]"), time.Now(), nil)
+		if err != nil {
+			t.Fatal(name + ": " + err.Error())
+		}
+		if 1 != len(messages) {
+			t.Fatal(name + ": message not found by folded nick")
+		}
+		if "Bob[m]" != messages[0].target {
+			t.Error(name + ": target not kept as typed")
+		}
+		if nil == store.rekey(nil) {
+			t.Error(name + ": nil fold function not detected")
+		}
+	}
+}
+
+// listing, marking and removing pending messages
+func Test_messageStore_pending_0(t *testing.T) {
+	t.Parallel()
+	for name, store := range testStores(t) {
+		saveTestMessage(store, nil, "alice", "testuser", "", "first")
+		saveTestMessage(store, nil, "bob", "testuser", "", "second")
+		saveTestMessage(store, nil, "carol", "testuser", "", "third")
+		saveTestMessage(store, nil, "alice", "otheruser", "", "not yours")
+		pending, err := store.pending("testuser")
+		if err != nil {
+			t.Fatal(name + ": " + err.Error())
+		}
+		if 3 != len(pending) || "first" != pending[0].content {
+			t.Fatal(name + ": wrong pending messages")
+		}
+		other, _ := store.pending("otheruser")
+
+		marked, err := store.markDelivered("testuser", []int64{pending[0].id, other[0].id}, time.Now())
+		if err != nil {
+			t.Fatal(name + ": " + err.Error())
+		}
+		if 1 != marked {
+			t.Error(name + ": wrong number of messages marked as delivered")
+		}
+		removed, err := store.remove("testuser", []int64{pending[0].id, pending[1].id, other[0].id})
+		if err != nil {
+			t.Fatal(name + ": " + err.Error())
+		}
+		if 1 != removed {
+			t.Error(name + ": wrong number of messages removed")
+		}
+		pending, _ = store.pending("testuser")
+		if 1 != len(pending) || "third" != pending[0].content {
+			t.Error(name + ": wrong messages left")
+		}
+		other, _ = store.pending("otheruser")
+		if 1 != len(other) {
+			t.Error(name + ": message of other target touched")
+		}
+	}
+}
+
+// listing and retracting messages of a source
+func Test_messageStore_outgoing_0(t *testing.T) {
+	t.Parallel()
+	for name, store := range testStores(t) {
+		saveTestMessage(store, nil, "alice", "bob", "", "first")
+		saveTestMessage(store, nil, "alice", "carol", "", "second")
+		saveTestMessage(store, nil, "dave", "bob", "", "not yours")
+		outgoing, err := store.outgoing("alice")
+		if err != nil {
+			t.Fatal(name + ": " + err.Error())
+		}
+		if 2 != len(outgoing) || "first" != outgoing[0].content {
+			t.Fatal(name + ": wrong outgoing messages")
+		}
+		other, _ := store.outgoing("dave")
+		retracted, err := store.retract("alice", []int64{outgoing[0].id, other[0].id})
+		if err != nil {
+			t.Fatal(name + ": " + err.Error())
+		}
+		if 1 != retracted {
+			t.Error(name + ": wrong number of messages retracted")
+		}
+		pending, _ := store.pending("bob")
+		if 1 != len(pending) || "dave" != pending[0].source {
+			t.Error(name + ": wrong messages left")
+		}
+	}
+}
+
+// old messages are removed, undelivered ones are reported
+func Test_messageStore_expire_0(t *testing.T) {
+	t.Parallel()
+	now := time.Now()
+	for name, store := range testStores(t) {
+		for i, age := range []time.Duration{48 * time.Hour, 36 * time.Hour, time.Hour} {
+			msg := &offlineMessage{
+				target:    "testuser",
+				targetKey: "testuser",
+				source:    "alice",
+				sourceKey: "alice",
+				content:   strconv.Itoa(i),
+				created:   now.Add(-age),
+			}
+			if err := store.save(msg, nil); err != nil {
+				t.Fatal(name + ": " + err.Error())
+			}
+		}
+		pending, _ := store.pending("testuser")
+		store.markDelivered("testuser", []int64{pending[0].id}, now)
+
+		expired, err := store.expire(now.Add(-24 * time.Hour))
+		if err != nil {
+			t.Fatal(name + ": " + err.Error())
+		}
+		if 1 != len(expired) || "1" != expired[0].content {
+			t.Error(name + ": wrong undelivered messages expired")
+		}
+		pending, _ = store.pending("testuser")
+		if 1 != len(pending) || "2" != pending[0].content {
+			t.Error(name + ": young message removed")
+		}
+		expired, _ = store.expire(now.Add(-24 * time.Hour))
+		if 0 != len(expired) {
+			t.Error(name + ": messages expired twice")
+		}
+	}
+}
+
+// only undelivered messages count
+func Test_messageStore_countPending_0(t *testing.T) {
+	t.Parallel()
+	for name, store := range testStores(t) {
+		saveTestMessage(store, nil, "alice", "testuser", "", "first")
+		saveTestMessage(store, nil, "bob", "otheruser", "", "second")
+		saveTestMessage(store, nil, "carol", "testuser", "", "third")
+		store.takePending("otheruser", time.Now(), nil)
+		count, err := store.countPending()
+		if err != nil {
+			t.Fatal(name + ": " + err.Error())
+		}
+		if 2 != count {
+			t.Error(name + ": wrong number of pending messages: " + strconv.Itoa(count))
+		}
+	}
+}
+
+// content is encrypted in the wrapped store only
+func Test_encryptedMessageStore_0(t *testing.T) {
+	t.Parallel()
+	keys, _ := parseKeyring([]string{testKey1})
+	if _, err := newEncryptedMessageStore(nil, keys, createLogger("")); err == nil {
+		t.Error("nil message store not detected")
+	}
+	if _, err := newEncryptedMessageStore(newMemoryMessageStore(), nil, createLogger("")); err == nil {
+		t.Error("missing key not detected")
+	}
+	plain := newMemoryMessageStore()
+	store, err := newEncryptedMessageStore(plain, keys, createLogger(""))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	saveTestMessage(store, nil, "alice", "testuser", "", "secret")
+	raw, _ := plain.pending("testuser")
+	if 1 != len(raw) || "secret" == raw[0].content {
+		t.Error("content not encrypted")
+	}
+	for _, list := range []func() ([]offlineMessage, error){
+		func() ([]offlineMessage, error) { return store.pending("testuser") },
+		func() ([]offlineMessage, error) { return store.outgoing("alice") },
+		func() ([]offlineMessage, error) { return store.takePending("testuser", time.Now(), nil) },
+	} {
+		messages, err := list()
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if 1 != len(messages) || "secret" != messages[0].content {
+			t.Error("content not decrypted")
+		}
+	}
+}
+
+// messages failing to decrypt are skipped, not lost
+func Test_encryptedMessageStore_1(t *testing.T) {
+	t.Parallel()
+	keys, _ := parseKeyring([]string{testKey1})
+	if _, err := newEncryptedMessageStore(newMemoryMessageStore(), keys, nil); err == nil {
+		t.Error("nil logger not detected")
+	}
+	for name, plain := range testStores(t) {
+		store, err := newEncryptedMessageStore(plain, keys, createLogger(""))
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		plain.save(&offlineMessage{target: "bob", targetKey: "bob", source: "mallory", sourceKey: "mallory", content: "AAAA", keyID: "zz", created: time.Now()}, nil)
+		saveTestMessage(store, nil, "alice", "bob", "", "hello bob")
+		messages, err := store.takePending("bob", time.Now(), nil)
+		if err != nil {
+			t.Fatal(name + ": " + err.Error())
+		}
+		if 1 != len(messages) || "hello bob" != messages[0].content {
+			t.Error(name + ": decryptable message not delivered")
+		}
+		raw, _ := plain.pending("bob")
+		if 1 != len(raw) || "mallory" != raw[0].source {
+			t.Error(name + ": message failing to decrypt not kept")
+		}
+		if listed, _ := store.about("bob"); 1 != len(listed) {
+			t.Error(name + ": message failing to decrypt listed")
+		}
+	}
+}
+
+// existing messages are rewritten with the current key
+func Test_reencryptDatabase_0(t *testing.T) {
+	t.Parallel()
+	sqlite := openTestStore(t)
+	old, _ := parseKeyring([]string{testKey1})
+	rotated, _ := parseKeyring([]string{testKey2, testKey1})
+	saveTestMessage(sqlite, nil, "alice", "testuser", "", "plain")
+	encrypted, _ := newEncryptedMessageStore(sqlite, old, createLogger(""))
+	saveTestMessage(encrypted, nil, "alice", "testuser", "", "old key")
+
+	count, err := reencryptDatabase(sqlite.db, rotated)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if 2 != count {
+		t.Error("wrong number of messages re-encrypted: " + strconv.Itoa(count))
+	}
+	raw, _ := sqlite.pending("testuser")
+	for _, msg := range raw {
+		if "k2" != msg.keyID || strings.Contains(msg.content, "plain") {
+			t.Error("message not encrypted with current key")
+		}
+	}
+	current, _ := parseKeyring([]string{testKey2})
+	store, _ := newEncryptedMessageStore(sqlite, current, createLogger(""))
+	messages, err := store.pending("testuser")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if 2 != len(messages) || "plain" != messages[0].content || "old key" != messages[1].content {
+		t.Error("content changed by re-encryption")
+	}
+	count, _ = reencryptDatabase(sqlite.db, rotated)
+	if 0 != count {
+		t.Error("messages re-encrypted twice")
+	}
+}
+
+// all messages of a nick, delivered or not
+func Test_messageStore_about_0(t *testing.T) {
+	t.Parallel()
+	for name, store := range testStores(t) {
+		saveTestMessage(store, nil, "alice", "testuser", "", "first")
+		saveTestMessage(store, nil, "testuser", "bob", "", "second")
+		saveTestMessage(store, nil, "alice", "bob", "", "third")
+		store.takePending("testuser", time.Now(), nil)
+		messages, err := store.about("testuser")
+		if err != nil {
+			t.Fatal(name + ": " + err.Error())
+		}
+		if 2 != len(messages) || "" != messages[0].content || "second" != messages[1].content {
+			t.Fatal(name + ": wrong messages")
+		}
+		if messages[0].delivered.IsZero() || !messages[1].delivered.IsZero() {
+			t.Error(name + ": wrong delivery time")
+		}
+		removed, err := store.forget("testuser")
+		if err != nil {
+			t.Fatal(name + ": " + err.Error())
+		}
+		if 2 != removed {
+			t.Error(name + ": wrong number of messages removed")
+		}
+		messages, _ = store.about("testuser")
+		if 0 != len(messages) {
+			t.Error(name + ": messages not removed")
+		}
+		if count, _ := store.countPending(); 1 != count {
+			t.Error(name + ": messages of others removed")
+		}
+	}
+}
+
+// the public flag is kept
+func Test_messageStore_save_1(t *testing.T) {
+	t.Parallel()
+	for name, store := range testStores(t) {
+		msg := &offlineMessage{target: "bob", targetKey: "bob", source: "alice", sourceKey: "alice", content: "hi", context: "#foo", public: true, created: time.Now()}
+		if err := store.save(msg, nil); err != nil {
+			t.Fatal(name + ": " + err.Error())
+		}
+		pending, _ := store.pending("bob")
+		if 1 != len(pending) || !pending[0].public {
+			t.Error(name + ": public flag lost")
+		}
+	}
+}
+
+// stores of different networks share the database and the count of
+// pending messages, but not messages
+func Test_sqliteMessageStore_network_0(t *testing.T) {
+	t.Parallel()
+	freenode := openTestStore(t)
+	oftc, err := newSQLiteMessageStore(freenode.db, "oftc")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer oftc.close()
+	if _, err = newSQLiteMessageStore(freenode.db, ""); err == nil {
+		t.Error("empty network name not detected")
+	}
+	saveTestMessage(freenode, nil, "alice", "bob", "", "on freenode")
+	saveTestMessage(oftc, nil, "alice", "bob", "", "on oftc")
+	for name, store := range map[string]messageStore{"freenode": freenode, "oftc": oftc} {
+		pending, _ := store.pending("bob")
+		if 1 != len(pending) || "on "+name != pending[0].content {
+			t.Error(name + ": messages of other network visible")
+		}
+		if count, _ := store.countPending(); 2 != count {
+			t.Error(name + ": messages of other network not counted")
+		}
+	}
+	if removed, _ := oftc.forget("alice"); 1 != removed {
+		t.Error("messages of other network removed")
+	}
+	if pending, _ := freenode.pending("bob"); 1 != len(pending) {
+		t.Error("messages of other network removed")
+	}
+}
+
+// plain text looking like encrypted content is still plain text
+func Test_reencryptDatabase_1(t *testing.T) {
+	t.Parallel()
+	sqlite := openTestStore(t)
+	keys, _ := parseKeyring([]string{testKey1})
+	saveTestMessage(sqlite, nil, "alice", "bob", "", "enc:v1:zz:AAAA")
+	count, err := reencryptDatabase(sqlite.db, keys)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if 1 != count {
+		t.Error("wrong number of messages re-encrypted: " + strconv.Itoa(count))
+	}
+	store, _ := newEncryptedMessageStore(sqlite, keys, createLogger(""))
+	messages, _ := store.pending("bob")
+	if 1 != len(messages) || "enc:v1:zz:AAAA" != messages[0].content {
+		t.Error("content changed by encryption")
+	}
+}
+
+// encrypted content can't be moved to another message
+func Test_encryptedMessageStore_2(t *testing.T) {
+	t.Parallel()
+	sqlite := openTestStore(t)
+	keys, _ := parseKeyring([]string{testKey1})
+	store, _ := newEncryptedMessageStore(sqlite, keys, createLogger(""))
+	saveTestMessage(store, nil, "alice", "bob", "", "for bob")
+	saveTestMessage(store, nil, "mallory", "bob", "", "from mallory")
+	_, err := sqlite.db.Exec("UPDATE messages SET content = (SELECT content FROM messages WHERE source = 'alice') WHERE source = 'mallory'")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	messages, _ := store.pending("bob")
+	if 1 != len(messages) || "alice" != messages[0].source {
+		t.Error("moved content not detected")
+	}
+}
+
+// encrypted messages stay readable after VACUUM
+func Test_encryptedMessageStore_3(t *testing.T) {
+	t.Parallel()
+	sqlite := openTestStore(t)
+	keys, _ := parseKeyring([]string{testKey1})
+	store, _ := newEncryptedMessageStore(sqlite, keys, createLogger(""))
+	for _, content := range []string{"first", "second", "third"} {
+		if err := saveTestMessage(store, nil, "alice", "bob", "", content); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	for _, statement := range []string{"DELETE FROM messages WHERE id = 1", "VACUUM"} {
+		if _, err := sqlite.db.Exec(statement); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	messages, err := store.takePending("bob", time.Now(), nil)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if 2 != len(messages) || "second" != messages[0].content || "third" != messages[1].content {
+		t.Error("messages not readable after VACUUM")
+	}
+}
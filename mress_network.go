@@ -0,0 +1,426 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"github.com/thoj/go-ircevent" // imported as "irc"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Name of the network configured in the section "IRC" and of the
+// messages stored before mress supported several networks.
+const defaultNetwork = "default"
+
+// States of the connection to a network, every transition is logged.
+const (
+	stateDisconnected = "disconnected"
+	stateConnecting   = "connecting"
+	stateConnected    = "connected"
+	stateRegistered   = "registered" // welcomed by the server (001)
+	stateWaiting      = "waiting"    // for the next connection attempt
+	stateStopped      = "stopped"    // quit or gave up
+)
+
+// Move the messages of the network "default" (stored before mress
+// supported several networks) to the configured legacy-network. Without
+// one, log how many of them belong to no configured network.
+func adoptLegacyMessages(db *sql.DB, config *Config, logger *log.Logger) error {
+	if 0 < len(config.legacyNetwork) {
+		moved, err := moveMessages(db, defaultNetwork, config.legacyNetwork)
+		if err != nil {
+			return err
+		}
+		if 0 < moved {
+			logger.Println("moved " + strconv.Itoa(moved) + " messages of network " + defaultNetwork + " to " + config.legacyNetwork)
+		}
+		return nil
+	}
+	for _, network := range config.networks {
+		if defaultNetwork == network.name {
+			return nil
+		}
+	}
+	orphaned, err := countMessages(db, defaultNetwork)
+	if err != nil {
+		return err
+	}
+	if 0 < orphaned {
+		logger.Println(strconv.Itoa(orphaned) + " messages of network " + defaultNetwork + " belong to no configured network, set legacy-network to move them")
+	}
+	return nil
+}
+
+// Settings of an IRC network mress connects to.
+type networkConfig struct {
+	name     string // namespace of the network in the database
+	server   string
+	port     int
+	useTLS   bool
+	nick     string
+	password string
+	channels []channelConfig
+	tls      tlsOptions
+	sasl     saslConfig
+	nickserv nickServConfig
+	// consecutive failed connection attempts before giving up,
+	// retry forever if 0
+	maxRetries int
+}
+
+// Settings of the offline messenger shared by all networks.
+type offlineSettings struct {
+	pushLimit     int
+	maxAge        time.Duration
+	notifyExpired bool
+	quota         offlineQuota
+	scope         string
+}
+
+// A connection to an IRC network with everything attached to it:
+// its own message store (namespaced by network), roster, offline
+// messenger and command router. The connection is supervised by run().
+type ircNetwork struct {
+	config      networkConfig
+	con         *irc.Connection
+	store       messageStore
+	roster      *channelRoster
+	messenger   *offlineMessenger
+	nickserv    *nickServ
+	sasl        *saslExchange // nil without SASL
+	logger      *log.Logger
+	stopJanitor chan struct{}
+	janitorDone chan struct{}
+	// delays between connection attempts, see backoff
+	minDelay time.Duration
+	maxDelay time.Duration
+
+	mutex      sync.Mutex
+	state      string
+	registered bool          // welcomed since the last connection attempt
+	quitting   bool          // quit() was called
+	authError  string        // why SASL authentication was rejected
+	stop       chan struct{} // closed by quit()
+}
+
+// Set up a network: create the message store in db (encrypted if keys
+// are enabled), the IRC connection and all callbacks. Log lines are
+// prefixed with the network name. Call run() afterwards.
+func newNetwork(config networkConfig, db *sql.DB, keys *keyring, settings offlineSettings, debug bool, logger *log.Logger) (*ircNetwork, error) {
+	if logger == nil {
+		return nil, fmt.Errorf("logger nil pointer")
+	}
+	if len(config.name) == 0 {
+		return nil, fmt.Errorf("network name of zero-length")
+	}
+	if len(config.server) == 0 {
+		return nil, fmt.Errorf("no server configured for network " + config.name)
+	}
+	if len(config.nick) == 0 {
+		return nil, fmt.Errorf("no nickname configured for network " + config.name)
+	}
+	n := &ircNetwork{
+		config:      config,
+		logger:      log.New(logger.Writer(), logger.Prefix()+"["+config.name+"] ", logger.Flags()),
+		stopJanitor: make(chan struct{}),
+		janitorDone: make(chan struct{}),
+		minDelay:    defaultReconnectDelay,
+		maxDelay:    defaultMaxReconnectDelay,
+		state:       stateDisconnected,
+		stop:        make(chan struct{}),
+	}
+
+	// storage namespaced by network
+	var err error
+	n.store, err = newSQLiteMessageStore(db, config.name)
+	if err != nil {
+		return nil, err
+	}
+	if keys.enabled() {
+		n.store, err = newEncryptedMessageStore(n.store, keys, n.logger)
+		if err != nil {
+			n.store.close()
+			return nil, err
+		}
+	}
+
+	// create IRC connection
+	n.con = irc.IRC(config.nick, "mress")
+	if nil == n.con {
+		n.store.close()
+		return nil, fmt.Errorf("creating IRC connection failed")
+	}
+	n.con.Password = config.password
+	if 0 < len(n.con.Password) {
+		n.logger.Println("password is used")
+	}
+	n.con.UseTLS = config.useTLS
+	if config.useTLS {
+		n.logger.Println("using TLS encrypted connection")
+	} else {
+		n.logger.Println("using cleartext connection")
+	}
+	n.con.Debug = debug
+	err = n.setupTLS()
+	if err != nil {
+		n.store.close()
+		return nil, err
+	}
+	err = n.setupSASL()
+	if err != nil {
+		n.store.close()
+		return nil, err
+	}
+
+	err = n.addCallbacks(settings)
+	if err != nil {
+		n.store.close()
+		return nil, err
+	}
+	return n, nil
+}
+
+// Register joining, casemapping, roster, offline messenger and commands.
+func (n *ircNetwork) addCallbacks(settings offlineSettings) error {
+	irccon := n.con
+	logger := n.logger
+	channels := n.config.channels
+	if 0 == len(channels) {
+		logger.Println("no channel to join")
+	}
+	// compare nicks according to the casemapping of the server
+	nicks := newNickMapper()
+
+	// (re)join all channels whenever the server welcomes us,
+	// after identifying with NickServ if configured
+	nickserv, err := newNickServ(n.config.nickserv, n.config.nick, nicks, n.joinChannels, logger)
+	if err != nil {
+		return err
+	}
+	n.nickserv = nickserv
+	irccon.AddCallback("001", func(e *irc.Event) {
+		n.mutex.Lock()
+		n.registered = true
+		n.mutex.Unlock()
+		n.setState(stateRegistered)
+		nickserv.welcome(irccon)
+	})
+	irccon.AddCallback("900", func(e *irc.Event) {
+		nickserv.loggedIn()
+	})
+	irccon.AddCallback("NOTICE", func(e *irc.Event) {
+		nickserv.handleNotice(e, irccon)
+	})
+	irccon.AddCallback("NICK", func(e *irc.Event) {
+		nickserv.handleNick(e, irccon)
+	})
+
+	irccon.AddCallback("005", func(e *irc.Event) {
+		changed, err := nicks.handleISupport(e)
+		if err != nil {
+			logger.Println(err.Error())
+		}
+		if !changed {
+			return
+		}
+		logger.Println("server uses casemapping " + nicks.mapping().String())
+		err = n.store.rekey(nicks.fold)
+		if err != nil {
+			logger.Println("rekeying offline messages failed")
+			logger.Println(err.Error())
+		}
+	})
+	// keep track of who is around
+	roster := newChannelRoster(nicks)
+	n.roster = roster
+	// offline messenger
+	messenger, err := newOfflineMessenger(n.store, nicks, roster, logger)
+	if err != nil {
+		return fmt.Errorf("creating offline messenger failed: %v", err)
+	}
+	messenger.configure(settings, channels)
+	n.messenger = messenger
+	// one callback per code, callbacks run in random order
+	for _, code := range []string{"353", "JOIN", "PART", "KICK", "QUIT", "NICK", "PRIVMSG"} {
+		irccon.AddCallback(code, func(e *irc.Event) {
+			messenger.track(e, irccon, irccon.GetNick())
+		})
+	}
+	irccon.AddCallback("330", messenger.handleWhoisAccount)
+	irccon.AddCallback("318", messenger.handleEndOfWhois)
+	// commands sent to mress
+	router := newCommandRouter(irccon.GetNick, nicks, logger)
+	commands := map[string]commandHandler{
+		"tell":     messenger.tellCommand,
+		"ptell":    messenger.tellCommand,
+		"inbox":    messenger.inboxCommand,
+		"read":     messenger.inboxCommand,
+		"delete":   messenger.inboxCommand,
+		"clear":    messenger.inboxCommand,
+		"outbox":   messenger.outboxCommand,
+		"untell":   messenger.outboxCommand,
+		"mydata":   messenger.privacyCommand,
+		"forgetme": messenger.privacyCommand,
+	}
+	for name, handler := range commands {
+		err = router.register(name, handler)
+		if err != nil {
+			logger.Println(err.Error())
+		}
+	}
+	irccon.AddCallback("PRIVMSG", func(e *irc.Event) {
+		router.dispatch(e, irccon)
+	})
+	return nil
+}
+
+// Join all channels of the network.
+func (n *ircNetwork) joinChannels() {
+	n.mutex.Lock()
+	channels := n.config.channels
+	n.mutex.Unlock()
+	for _, channel := range channels {
+		n.logger.Println("joining " + channel.name)
+		if 0 < len(channel.key) {
+			n.con.Join(channel.name + " " + channel.key)
+		} else {
+			n.con.Join(channel.name)
+		}
+	}
+}
+
+// Log a transition to a new connection state.
+func (n *ircNetwork) setState(state string) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	if state == n.state {
+		return
+	}
+	n.logger.Println("connection " + n.state + " -> " + state)
+	n.state = state
+}
+
+// Report if quit() was called.
+func (n *ircNetwork) stopping() bool {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	return n.quitting
+}
+
+// Connect to the server of the network. The first attempt connects,
+// later ones reconnect the existing connection.
+func (n *ircNetwork) connect(first bool) error {
+	socketstring := n.config.server + ":" + strconv.Itoa(n.config.port)
+	n.mutex.Lock()
+	n.registered = false
+	n.authError = ""
+	n.mutex.Unlock()
+	n.nickserv.reset()
+	n.setState(stateConnecting)
+	n.logger.Println("connecting to " + socketstring)
+	if n.sasl != nil {
+		// last callbacks added before connecting, see prepare()
+		n.sasl.prepare()
+	}
+	var err error
+	if first {
+		err = n.con.Connect(socketstring)
+	} else {
+		err = n.con.Reconnect()
+	}
+	if err != nil {
+		return fmt.Errorf("connecting to %s failed: %v", socketstring, err)
+	}
+	n.setState(stateConnected)
+	return nil
+}
+
+// Keep the network connected until quit() is called: reconnect after
+// errors with exponential backoff, authenticate and rejoin all channels
+// (see addCallbacks()). Gives up after maxRetries consecutive failed
+// attempts or at once if SASL authentication is rejected. Expires offline
+// messages meanwhile and releases the message store at the end. Returns
+// an error if it gave up.
+func (n *ircNetwork) run() error {
+	go n.messenger.janitor(n.con.GetNick, n.stopJanitor, n.janitorDone)
+	defer func() {
+		close(n.stopJanitor)
+		<-n.janitorDone
+		n.store.close()
+	}()
+
+	retry := newBackoff(n.minDelay, n.maxDelay)
+	failures := 0
+	connected := false
+	for !n.stopping() {
+		err := n.connect(!connected)
+		registered := false
+		if err == nil {
+			connected = true
+			// every (re)connect creates a new error channel
+			select {
+			case err = <-n.con.ErrorChan():
+			case <-n.stop:
+			}
+			n.roster.clear()
+			if n.stopping() {
+				break
+			}
+			n.setState(stateDisconnected)
+			n.mutex.Lock()
+			registered = n.registered
+			n.mutex.Unlock()
+		}
+		if err != nil {
+			n.logger.Println(err.Error())
+		}
+		if n.con.Connected() {
+			// stop reading and writing the old connection (like Loop())
+			n.con.Disconnect()
+		}
+		if reason := n.authenticationRejected(); 0 < len(reason) {
+			// retrying won't help with wrong credentials
+			n.setState(stateStopped)
+			return fmt.Errorf("giving up, SASL authentication rejected: %s", reason)
+		}
+		if registered {
+			// the connection worked, a dropped session is no failed attempt
+			failures = 0
+			retry.reset()
+		} else {
+			failures++
+		}
+		n.mutex.Lock()
+		maxRetries := n.config.maxRetries
+		n.mutex.Unlock()
+		if 0 < maxRetries && failures >= maxRetries {
+			n.setState(stateStopped)
+			return fmt.Errorf("giving up after %d failed connection attempts", failures)
+		}
+		delay := retry.next()
+		n.setState(stateWaiting)
+		n.logger.Println("reconnecting in " + delay.Round(time.Second).String())
+		select {
+		case <-time.After(delay):
+		case <-n.stop:
+		}
+	}
+	n.setState(stateStopped)
+	return nil
+}
+
+// Disconnect from the network, ends run().
+func (n *ircNetwork) quit() {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	if n.quitting {
+		return
+	}
+	n.quitting = true
+	close(n.stop)
+	if stateConnected == n.state || stateRegistered == n.state {
+		n.con.Quit()
+	}
+}
@@ -0,0 +1,339 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"database/sql"
+	"log"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fresh database in a temporary directory
+func openTestDatabase(t *testing.T) *sql.DB {
+	db, err := openDatabase(filepath.Join(t.TempDir(), "testnetwork.db"))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+// a connection to the local IRC server of a test
+type testClient struct {
+	t      *testing.T
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+// Read lines of the client until one starts with prefix, fail the test
+// if the client disconnects first.
+func (c *testClient) expect(prefix string) string {
+	c.conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	for {
+		line, err := c.reader.ReadString('\n')
+		if err != nil {
+			c.t.Errorf("client did not send '%s': %v", prefix, err)
+			return ""
+		}
+		line = strings.TrimRight(line, "\r\n")
+		if 0 == strings.Index(line, prefix) {
+			return line
+		}
+	}
+}
+
+// Read the next line of the client, it has to start with prefix.
+func (c *testClient) expectNext(prefix string) {
+	c.conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	line, err := c.reader.ReadString('\n')
+	if err != nil {
+		c.t.Errorf("client did not send '%s': %v", prefix, err)
+		return
+	}
+	if line = strings.TrimRight(line, "\r\n"); 0 != strings.Index(line, prefix) {
+		c.t.Errorf("client sent '%s' instead of '%s'", line, prefix)
+	}
+}
+
+// Send a line to the client.
+func (c *testClient) send(line string) {
+	c.conn.Write([]byte(line + "\r\n"))
+}
+
+// Start a local IRC server handing the n-th connection to the n-th
+// session, connections without a session are closed at once. Reports
+// the number of every accepted connection, returns the port.
+func startTestServer(t *testing.T, accepted chan<- int, sessions ...func(c *testClient)) int {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for i := 0; ; i++ {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			accepted <- i + 1
+			if i < len(sessions) {
+				sessions[i](&testClient{t: t, conn: conn, reader: bufio.NewReader(conn)})
+			}
+			conn.Close()
+		}
+	}()
+	return listener.Addr().(*net.TCPAddr).Port
+}
+
+func Test_newNetwork_0(t *testing.T) {
+	t.Parallel()
+	db := openTestDatabase(t)
+	logger := createLogger("")
+	valid := networkConfig{name: "oftc", server: "irc.oftc.net", port: 6697, nick: "mress"}
+	broken := map[string]networkConfig{
+		"name":   {server: "irc.oftc.net", nick: "mress"},
+		"server": {name: "oftc", nick: "mress"},
+		"nick":   {name: "oftc", server: "irc.oftc.net"},
+	}
+	for what, config := range broken {
+		if _, err := newNetwork(config, db, nil, offlineSettings{}, false, logger); err == nil {
+			t.Error("missing " + what + " not detected")
+		}
+	}
+	if _, err := newNetwork(valid, db, nil, offlineSettings{}, false, nil); err == nil {
+		t.Error("nil logger not detected")
+	}
+	if _, err := newNetwork(valid, nil, nil, offlineSettings{}, false, logger); err == nil {
+		t.Error("nil database not detected")
+	}
+}
+
+func Test_newNetwork_1(t *testing.T) {
+	t.Parallel()
+	db := openTestDatabase(t)
+	keys, _ := parseKeyring([]string{testKey1})
+	config := networkConfig{name: "oftc", server: "irc.oftc.net", port: 6697, useTLS: true, nick: "mress", password: "secret"}
+	settings := offlineSettings{pushLimit: 3, scope: scopeChannel, quota: defaultOfflineQuota}
+	network, err := newNetwork(config, db, keys, settings, false, createLogger(""))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer network.store.close()
+	if _, ok := network.store.(*encryptedMessageStore); !ok {
+		t.Error("message store not encrypted")
+	}
+	if "secret" != network.con.Password || !network.con.UseTLS {
+		t.Error("connection not configured")
+	}
+	if 3 != network.messenger.pushLimit || scopeChannel != network.messenger.scope {
+		t.Error("offline messenger not configured")
+	}
+	if "[mress] [oftc] " != network.logger.Prefix() {
+		t.Error("log lines not prefixed with network")
+	}
+}
+
+// gives up after max-retries failed attempts
+func Test_ircNetwork_run_0(t *testing.T) {
+	t.Parallel()
+	config := networkConfig{name: "local", server: "127.0.0.1", port: 1, nick: "mress", maxRetries: 2}
+	network, err := newNetwork(config, openTestDatabase(t), nil, offlineSettings{}, false, createLogger(""))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	network.minDelay = time.Millisecond
+	network.maxDelay = time.Millisecond
+	done := make(chan error)
+	go func() { done <- network.run() }()
+	select {
+	case err = <-done:
+		if err == nil || "giving up after 2 failed connection attempts" != err.Error() {
+			t.Error("did not give up after 2 attempts")
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("did not give up after max-retries")
+	}
+	if stateStopped != network.state {
+		t.Error("wrong state " + network.state)
+	}
+}
+
+// quit stops retrying
+func Test_ircNetwork_run_1(t *testing.T) {
+	t.Parallel()
+	config := networkConfig{name: "local", server: "127.0.0.1", port: 1, nick: "mress"}
+	network, err := newNetwork(config, openTestDatabase(t), nil, offlineSettings{}, false, createLogger(""))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	done := make(chan error)
+	go func() { done <- network.run() }()
+	network.quit()
+	network.quit()
+	select {
+	case err = <-done:
+		if err != nil {
+			t.Error(err.Error())
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("did not stop after quit")
+	}
+}
+
+// reconnects after the server closed the connection
+func Test_ircNetwork_run_2(t *testing.T) {
+	t.Parallel()
+	accepted := make(chan int, 10)
+	stop := make(chan struct{})
+	port := startTestServer(t, accepted, func(c *testClient) {
+		c.expect("USER ")
+	}, func(c *testClient) {
+		<-stop
+	})
+	defer close(stop)
+	config := networkConfig{name: "local", server: "127.0.0.1", port: port, nick: "mress"}
+	network, err := newNetwork(config, openTestDatabase(t), nil, offlineSettings{}, false, createLogger(""))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	network.minDelay = time.Millisecond
+	network.maxDelay = time.Millisecond
+	done := make(chan error)
+	go func() { done <- network.run() }()
+	for i := 1; i <= 2; i++ {
+		select {
+		case <-accepted:
+		case <-time.After(10 * time.Second):
+			t.Fatalf("connection %d not attempted", i)
+		}
+	}
+	network.quit()
+	select {
+	case err = <-done:
+		if err != nil {
+			t.Error(err.Error())
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("did not stop after quit")
+	}
+}
+
+// a dropped session is not counted as failed attempt
+func Test_ircNetwork_run_3(t *testing.T) {
+	t.Parallel()
+	accepted := make(chan int, 10)
+	port := startTestServer(t, accepted, func(c *testClient) {
+		c.expect("USER ")
+		c.send(":irc.local 001 mress :Welcome")
+	})
+	config := networkConfig{name: "local", server: "127.0.0.1", port: port, nick: "mress", maxRetries: 1}
+	network, err := newNetwork(config, openTestDatabase(t), nil, offlineSettings{}, false, createLogger(""))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	network.minDelay = time.Millisecond
+	network.maxDelay = time.Millisecond
+	done := make(chan error)
+	go func() { done <- network.run() }()
+	select {
+	case err = <-done:
+		if err == nil || "giving up after 1 failed connection attempts" != err.Error() {
+			t.Errorf("wrong error %v", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("did not give up after max-retries")
+	}
+	if 2 != len(accepted) {
+		t.Errorf("%d connections instead of 2", len(accepted))
+	}
+}
+
+// a ptell is delivered in the channel when the recipient joins
+func Test_ircNetwork_addCallbacks_0(t *testing.T) {
+	t.Parallel()
+	stop := make(chan struct{})
+	delivered := make(chan string, 1)
+	port := startTestServer(t, make(chan int, 10), func(c *testClient) {
+		c.expect("USER ")
+		c.send(":irc.local 001 mress :Welcome")
+		c.expect("JOIN #foo")
+		c.send(":mress!mress@localhost JOIN #foo")
+		c.send(":irc.local 353 mress = #foo :mress @alice")
+		c.send(":bob!bob@localhost JOIN #foo")
+		delivered <- c.expect("PRIVMSG ")
+		<-stop
+	})
+	defer close(stop)
+	config := networkConfig{name: "local", server: "127.0.0.1", port: port, nick: "mress",
+		channels: []channelConfig{{name: "#foo", offlineMessages: true}}}
+	network, err := newNetwork(config, openTestDatabase(t), nil, offlineSettings{}, false, createLogger(""))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	network.messenger.tellCommand(&command{name: "ptell", args: "bob: hello", nick: "alice", channel: "#foo"}, &recordingSender{})
+	done := make(chan error)
+	go func() { done <- network.run() }()
+	select {
+	case line := <-delivered:
+		if "PRIVMSG #foo :bob: alice said (just now): hello" != line {
+			t.Error("not delivered in public: " + line)
+		}
+	case <-time.After(10 * time.Second):
+		t.Error("not delivered")
+	}
+	network.quit()
+	<-done
+}
+
+// passwords never end up in the log
+func Test_newNetwork_2(t *testing.T) {
+	t.Parallel()
+	var buffer bytes.Buffer
+	logger := log.New(&buffer, "[mress] ", 0)
+	config := networkConfig{name: "oftc", server: "irc.oftc.net", port: 6697, useTLS: true, nick: "mress", password: "pass-s3cr3t"}
+	config.sasl = saslConfig{mechanism: saslPlain, login: "mress", password: "sasl-s3cr3t"}
+	config.nickserv = nickServConfig{password: "nickserv-s3cr3t", recover: recoverRegain}
+	network, err := newNetwork(config, openTestDatabase(t), nil, offlineSettings{}, false, logger)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer network.store.close()
+	network.nickserv.identify(&recordingServicesClient{nick: "mress"})
+	if strings.Contains(buffer.String(), "s3cr3t") {
+		t.Error("password logged: " + buffer.String())
+	}
+}
+
+// messages of the network "default" are moved or reported
+func Test_adoptLegacyMessages_0(t *testing.T) {
+	t.Parallel()
+	db := openTestDatabase(t)
+	legacy, _ := newSQLiteMessageStore(db, defaultNetwork)
+	defer legacy.close()
+	saveTestMessage(legacy, nil, "alice", "bob", "", "left before")
+	var buffer bytes.Buffer
+	logger := log.New(&buffer, "", 0)
+	config := &Config{networks: []networkConfig{{name: "freenode"}, {name: "oftc"}}}
+	if err := adoptLegacyMessages(db, config, logger); err != nil {
+		t.Fatal(err.Error())
+	}
+	if !strings.Contains(buffer.String(), "1 messages of network default belong to no configured network") {
+		t.Error("orphaned messages not logged")
+	}
+	config.legacyNetwork = "oftc"
+	if err := adoptLegacyMessages(db, config, logger); err != nil {
+		t.Fatal(err.Error())
+	}
+	oftc, _ := newSQLiteMessageStore(db, "oftc")
+	defer oftc.close()
+	if pending, _ := oftc.pending("bob"); 1 != len(pending) || "left before" != pending[0].content {
+		t.Error("messages not moved")
+	}
+	if pending, _ := legacy.pending("bob"); 0 != len(pending) {
+		t.Error("messages left behind")
+	}
+}
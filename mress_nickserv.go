@@ -0,0 +1,241 @@
+package main
+
+import (
+	"fmt"
+	"github.com/thoj/go-ircevent" // imported as "irc"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Ways to get the configured nick back from whoever uses it.
+const (
+	recoverRegain = "regain" // services change our nick (Atheme, Anope 2)
+	recoverGhost  = "ghost"  // services disconnect the user, we change nick
+	recoverNone   = "no"
+)
+
+// Name of the nick services and how long to wait for them before
+// joining channels anyway.
+const (
+	nickServName    = "NickServ"
+	nickServTimeout = 30 * time.Second
+)
+
+// Settings of the identification with NickServ.
+type nickServConfig struct {
+	password string // empty if mress does not identify
+	recover  string // recoverRegain, recoverGhost or recoverNone (or empty)
+}
+
+// Report if the configured nick is recovered when taken.
+func (c nickServConfig) recovers() bool {
+	return recoverRegain == c.recover || recoverGhost == c.recover
+}
+
+// Check if the recovery method is known.
+func (c nickServConfig) validate() error {
+	switch c.recover {
+	case recoverRegain, recoverGhost, recoverNone, "":
+		return nil
+	}
+	return fmt.Errorf("unknown nickserv-recover '%s' (use regain, ghost or no)", c.recover)
+}
+
+// Talks to NickServ via an IRC connection. Implemented by
+// *irc.Connection, allows replacing the connection in tests.
+type nickServClient interface {
+	ircSender
+	Nick(nick string)
+	GetNick() string
+}
+
+// Identifies with NickServ after connecting, recovers the configured
+// nick if it is taken and holds back joining channels until identified
+// (so a cloak applies before joining) or nickServTimeout passed.
+type nickServ struct {
+	config nickServConfig
+	nick   string // configured nick
+	nicks  *nickMapper
+	join   func() // joins all channels
+	logger *log.Logger
+
+	mutex      sync.Mutex
+	identified bool        // logged in, e.g. via SASL
+	waiting    bool        // for NickServ to confirm, channels not joined yet
+	recovering bool        // asked NickServ to free our nick
+	fallback   string      // nick used while recovering
+	timer      *time.Timer // joins anyway if NickServ doesn't answer
+}
+
+// Create a NickServ client identifying nick.
+func newNickServ(config nickServConfig, nick string, nicks *nickMapper, join func(), logger *log.Logger) (*nickServ, error) {
+	if nicks == nil {
+		return nil, fmt.Errorf("nick mapper nil pointer")
+	}
+	if join == nil {
+		return nil, fmt.Errorf("join function nil pointer")
+	}
+	if logger == nil {
+		return nil, fmt.Errorf("logger nil pointer")
+	}
+	err := config.validate()
+	if err != nil {
+		return nil, err
+	}
+	return &nickServ{config: config, nick: nick, nicks: nicks, join: join, logger: logger}, nil
+}
+
+// Forget the state of the last connection.
+func (s *nickServ) reset() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.identified = false
+	s.waiting = false
+	s.recovering = false
+	if s.timer != nil {
+		s.timer.Stop()
+		s.timer = nil
+	}
+}
+
+// Handle RPL_LOGGEDIN (900), sent after SASL or IDENTIFY succeeded.
+func (s *nickServ) loggedIn() {
+	s.mutex.Lock()
+	s.identified = true
+	s.mutex.Unlock()
+	s.done()
+}
+
+// Handle the welcome (001): recover the nick and identify if
+// configured, join channels right away otherwise.
+func (s *nickServ) welcome(con nickServClient) {
+	s.mutex.Lock()
+	identified := s.identified
+	s.mutex.Unlock()
+	current := con.GetNick()
+	if !s.nicks.equal(s.nick, current) && s.config.recovers() && (0 < len(s.config.password) || identified) {
+		s.logger.Println("nick " + s.nick + " is taken, using " + current + " and recovering it via " + s.config.recover)
+		s.wait()
+		s.mutex.Lock()
+		s.recovering = true
+		s.fallback = current
+		s.mutex.Unlock()
+		con.Privmsg(nickServName, strings.ToUpper(s.config.recover)+" "+s.nick+s.passwordArgument())
+		return
+	}
+	if identified || 0 == len(s.config.password) {
+		s.join()
+		return
+	}
+	s.wait()
+	s.identify(con)
+}
+
+// Send IDENTIFY, never logs the password.
+func (s *nickServ) identify(con nickServClient) {
+	s.logger.Println("identifying with " + nickServName + " as " + s.nick)
+	con.Privmsg(nickServName, "IDENTIFY "+s.nick+" "+s.config.password)
+}
+
+// The password as last argument of a command, if there is one.
+func (s *nickServ) passwordArgument() string {
+	if 0 == len(s.config.password) {
+		return ""
+	}
+	return " " + s.config.password
+}
+
+// Hold back joining until done() or nickServTimeout.
+func (s *nickServ) wait() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.waiting {
+		return
+	}
+	s.waiting = true
+	s.timer = time.AfterFunc(nickServTimeout, func() {
+		s.logger.Println(nickServName + " did not confirm the identification, joining anyway")
+		s.done()
+	})
+}
+
+// Report if joining channels is held back, done() joins them later.
+func (s *nickServ) holdsJoins() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.waiting
+}
+
+// Stop waiting for NickServ and join channels (once).
+func (s *nickServ) done() {
+	s.mutex.Lock()
+	if !s.waiting {
+		s.mutex.Unlock()
+		return
+	}
+	s.waiting = false
+	s.recovering = false
+	if s.timer != nil {
+		s.timer.Stop()
+		s.timer = nil
+	}
+	s.mutex.Unlock()
+	s.join()
+}
+
+// Handle NOTICEs from NickServ: confirmed identification, rejected
+// password and ghosted nicks.
+// To be used as a callback for NOTICE.
+func (s *nickServ) handleNotice(e *irc.Event, con nickServClient) {
+	if e == nil || con == nil {
+		return
+	}
+	if !s.nicks.equal(nickServName, e.Nick) {
+		return
+	}
+	text := strings.ToLower(e.Message())
+	switch {
+	case strings.Contains(text, "you are now identified") || strings.Contains(text, "password accepted"):
+		s.logger.Println("identified with " + nickServName)
+		s.mutex.Lock()
+		s.identified = true
+		s.mutex.Unlock()
+		s.done()
+	case strings.Contains(text, "invalid password") || strings.Contains(text, "password incorrect"):
+		s.logger.Println(nickServName + " rejected the password, joining unidentified")
+		s.done()
+	case strings.Contains(text, "ghosted") || strings.Contains(text, "has been killed") || strings.Contains(text, "has been disconnected"):
+		s.mutex.Lock()
+		recovering := s.recovering
+		s.mutex.Unlock()
+		if recovering {
+			con.Nick(s.nick)
+		}
+	}
+}
+
+// Handle NICK: identify once the configured nick is ours again.
+// To be used as a callback for NICK.
+func (s *nickServ) handleNick(e *irc.Event, con nickServClient) {
+	if e == nil || con == nil || 0 == len(e.Arguments) {
+		return
+	}
+	s.mutex.Lock()
+	ours := s.recovering && s.nicks.equal(s.fallback, e.Nick) && s.nicks.equal(s.nick, e.Message())
+	identified := s.identified
+	if ours {
+		s.recovering = false
+	}
+	s.mutex.Unlock()
+	if !ours {
+		return
+	}
+	s.logger.Println("recovered nick " + s.nick)
+	if identified || 0 == len(s.config.password) {
+		s.done()
+		return
+	}
+	s.identify(con)
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"github.com/thoj/go-ircevent" // imported as "irc"
+	"reflect"
+	"testing"
+)
+
+// records messages and nick changes, the nick changes right away
+type recordingServicesClient struct {
+	recordingSender
+	nick string
+}
+
+func (r *recordingServicesClient) Nick(nick string) {
+	r.Privmsg("NICK", nick)
+	r.nick = nick
+}
+
+func (r *recordingServicesClient) GetNick() string {
+	return r.nick
+}
+
+// NickServ client counting joins
+func newTestNickServ(t *testing.T, config nickServConfig) (*nickServ, *int) {
+	joins := 0
+	nickserv, err := newNickServ(config, "mress", newNickMapper(), func() { joins++ }, createLogger(""))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	t.Cleanup(nickserv.reset)
+	return nickserv, &joins
+}
+
+func Test_newNickServ_0(t *testing.T) {
+	t.Parallel()
+	logger := createLogger("")
+	join := func() {}
+	if _, err := newNickServ(nickServConfig{}, "mress", nil, join, logger); err == nil {
+		t.Error("nil nick mapper not detected")
+	}
+	if _, err := newNickServ(nickServConfig{}, "mress", newNickMapper(), nil, logger); err == nil {
+		t.Error("nil join function not detected")
+	}
+	if _, err := newNickServ(nickServConfig{}, "mress", newNickMapper(), join, nil); err == nil {
+		t.Error("nil logger not detected")
+	}
+	if _, err := newNickServ(nickServConfig{recover: "release"}, "mress", newNickMapper(), join, logger); err == nil {
+		t.Error("unknown recovery not detected")
+	}
+}
+
+// joins right away without password or when logged in via SASL
+func Test_nickServ_welcome_0(t *testing.T) {
+	t.Parallel()
+	con := &recordingServicesClient{nick: "mress"}
+	nickserv, joins := newTestNickServ(t, nickServConfig{recover: recoverRegain})
+	nickserv.welcome(con)
+	if 1 != *joins || 0 != len(con.sent()) {
+		t.Error("did not join right away without password")
+	}
+
+	nickserv, joins = newTestNickServ(t, nickServConfig{password: "secret", recover: recoverRegain})
+	nickserv.loggedIn()
+	nickserv.welcome(con)
+	if 1 != *joins || 0 != len(con.sent()) {
+		t.Error("did not join right away when logged in")
+	}
+}
+
+// identifies and joins once confirmed
+func Test_nickServ_welcome_1(t *testing.T) {
+	t.Parallel()
+	con := &recordingServicesClient{nick: "mress"}
+	nickserv, joins := newTestNickServ(t, nickServConfig{password: "secret", recover: recoverRegain})
+	nickserv.welcome(con)
+	if !reflect.DeepEqual([]string{"NickServ IDENTIFY mress secret"}, con.sent()) {
+		t.Error("did not identify")
+	}
+	if 0 != *joins {
+		t.Error("joined before identified")
+	}
+	notice := &irc.Event{Code: "NOTICE", Nick: "bob", Arguments: []string{"mress", "You are now identified for mress."}}
+	nickserv.handleNotice(notice, con)
+	if 0 != *joins {
+		t.Error("took notice from someone else as confirmation")
+	}
+	notice.Nick = "NickServ"
+	nickserv.handleNotice(notice, con)
+	nickserv.handleNotice(notice, con)
+	nickserv.loggedIn()
+	if 1 != *joins {
+		t.Error("did not join exactly once after identified")
+	}
+}
+
+// regains a taken nick, then identifies
+func Test_nickServ_welcome_2(t *testing.T) {
+	t.Parallel()
+	con := &recordingServicesClient{nick: "mress_"}
+	nickserv, joins := newTestNickServ(t, nickServConfig{password: "secret", recover: recoverRegain})
+	nickserv.welcome(con)
+	con.nick = "mress"
+	nickserv.handleNick(&irc.Event{Code: "NICK", Nick: "mress_", Arguments: []string{"mress"}}, con)
+	expected := []string{"NickServ REGAIN mress secret", "NickServ IDENTIFY mress secret"}
+	if !reflect.DeepEqual(expected, con.sent()) {
+		t.Error("did not regain nick and identify")
+	}
+	if 0 != *joins {
+		t.Error("joined before identified")
+	}
+	nickserv.handleNotice(&irc.Event{Code: "NOTICE", Nick: "NickServ", Arguments: []string{"mress", "Password accepted - you are now recognized."}}, con)
+	if 1 != *joins {
+		t.Error("did not join after identified")
+	}
+}
+
+// ghosts a taken nick and takes it
+func Test_nickServ_welcome_3(t *testing.T) {
+	t.Parallel()
+	con := &recordingServicesClient{nick: "mress_"}
+	nickserv, joins := newTestNickServ(t, nickServConfig{password: "secret", recover: recoverGhost})
+	nickserv.welcome(con)
+	nickserv.handleNotice(&irc.Event{Code: "NOTICE", Nick: "NickServ", Arguments: []string{"mress_", "mress has been ghosted."}}, con)
+	nickserv.handleNick(&irc.Event{Code: "NICK", Nick: "mress_", Arguments: []string{"mress"}}, con)
+	expected := []string{"NickServ GHOST mress secret", "NICK mress", "NickServ IDENTIFY mress secret"}
+	if !reflect.DeepEqual(expected, con.sent()) {
+		t.Error("did not ghost nick and identify")
+	}
+	nickserv.handleNotice(&irc.Event{Code: "NOTICE", Nick: "NickServ", Arguments: []string{"mress", "Invalid password for mress."}}, con)
+	if 1 != *joins {
+		t.Error("did not join after rejected password")
+	}
+}
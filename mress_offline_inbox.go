@@ -0,0 +1,98 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Implements the inbox commands to fetch offline messages deliberately
+// instead of having them pushed. Only available as direct message.
+// To be registered with the command router as "inbox", "read", "delete"
+// and "clear".
+// mress commands: inbox, read <n>, delete <n>, clear
+func (m *offlineMessenger) inboxCommand(cmd *command, irc ircSender) {
+	// sanity checks
+	if cmd == nil {
+		return
+	}
+	if irc == nil {
+		return
+	}
+	if !cmd.direct() {
+		cmd.reply(irc, "your inbox is private, send me \""+cmd.name+"\" as direct message")
+		return
+	}
+
+	key := m.nicks.fold(cmd.nick)
+	pending, err := m.store.pending(key)
+	if err != nil {
+		m.logger.Println("reading inbox failed")
+		m.logger.Println(err.Error())
+		cmd.reply(irc, "sorry, reading your inbox failed")
+		return
+	}
+
+	switch cmd.name {
+	case "inbox":
+		if 0 == len(pending) {
+			cmd.reply(irc, "your inbox is empty")
+			return
+		}
+		cmd.reply(irc, "you have "+strconv.Itoa(len(pending))+" messages, \"read <n>\" shows one, \"delete <n>\" drops one, \"clear\" drops all")
+		now := time.Now()
+		for i, msg := range pending {
+			cmd.reply(irc, strconv.Itoa(i+1)+": from "+msg.source+" ("+formatAge(msg.created, now)+")")
+		}
+	case "read":
+		msg := inboxMessage(cmd, irc, pending)
+		if msg == nil {
+			return
+		}
+		_, err = m.store.markDelivered(key, []int64{msg.id}, time.Now())
+		if err != nil {
+			m.logger.Println("marking message as delivered failed")
+			m.logger.Println(err.Error())
+		}
+		cmd.reply(irc, formatOfflineMessage(msg))
+	case "delete":
+		msg := inboxMessage(cmd, irc, pending)
+		if msg == nil {
+			return
+		}
+		m.removeFromInbox(cmd, irc, key, []int64{msg.id})
+	case "clear":
+		ids := []int64{}
+		for _, msg := range pending {
+			ids = append(ids, msg.id)
+		}
+		m.removeFromInbox(cmd, irc, key, ids)
+	}
+}
+
+// Remove messages from the inbox of key and tell how many are gone.
+func (m *offlineMessenger) removeFromInbox(cmd *command, irc ircSender, key string, ids []int64) {
+	removed, err := m.store.remove(key, ids)
+	if err != nil {
+		m.logger.Println("removing messages failed")
+		m.logger.Println(err.Error())
+		cmd.reply(irc, "sorry, removing messages failed")
+		return
+	}
+	cmd.reply(irc, strconv.Itoa(removed)+" messages deleted")
+}
+
+// Pick the message numbered by the argument of cmd (as listed by
+// "inbox"). Replies and returns nil if the number is not valid.
+func inboxMessage(cmd *command, irc ircSender, pending []offlineMessage) *offlineMessage {
+	n, err := strconv.Atoi(strings.TrimSpace(cmd.args))
+	if err != nil {
+		cmd.reply(irc, "usage: "+cmd.name+" <n>, see \"inbox\" for the numbers")
+		return nil
+	}
+	if n < 1 || n > len(pending) {
+		cmd.reply(irc, "there is no message "+strconv.Itoa(n)+" in your inbox")
+		return nil
+	}
+	return &pending[n-1]
+}
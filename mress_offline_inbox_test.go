@@ -0,0 +1,95 @@
+package main
+
+import (
+	"testing"
+)
+
+// run an inbox command as direct message, return the replies
+func runInboxCommand(messenger *offlineMessenger, name, args string) []string {
+	con := &recordingSender{}
+	cmd := &command{name: name, args: args, nick: "testuser"}
+	messenger.inboxCommand(cmd, con)
+	return con.sent()
+}
+
+func Test_offlineMessenger_inboxCommand_0(t *testing.T) {
+	t.Parallel()
+	messenger := newTestMessenger(t)
+	sent := runInboxCommand(messenger, "inbox", "")
+	if 1 != len(sent) || "testuser your inbox is empty" != sent[0] {
+		t.Error("empty inbox not reported")
+	}
+	messenger.save("alice", "testuser", "", "first")
+	messenger.save("bob", "testuser", "#foo", "second")
+	sent = runInboxCommand(messenger, "inbox", "")
+	if 3 != len(sent) {
+		t.Fatal("wrong number of replies")
+	}
+	if "testuser 2: from bob (just now)" != sent[2] {
+		t.Error("wrong listing: " + sent[2])
+	}
+}
+
+// read marks the message as delivered, numbers are checked
+func Test_offlineMessenger_inboxCommand_1(t *testing.T) {
+	t.Parallel()
+	messenger := newTestMessenger(t)
+	messenger.save("alice", "testuser", "", "first")
+	messenger.save("bob", "testuser", "", "second")
+	sent := runInboxCommand(messenger, "read", "2")
+	if 1 != len(sent) || "testuser message from bob (just now): second\n" != sent[0] {
+		t.Error("wrong message read")
+	}
+	pending, _ := messenger.store.pending("testuser")
+	if 1 != len(pending) || "first" != pending[0].content {
+		t.Error("read message still pending")
+	}
+	for _, args := range []string{"", "two", "0", "2"} {
+		sent = runInboxCommand(messenger, "read", args)
+		if 1 != len(sent) {
+			t.Error("wrong number of replies for '" + args + "'")
+		}
+	}
+}
+
+// delete and clear
+func Test_offlineMessenger_inboxCommand_2(t *testing.T) {
+	t.Parallel()
+	messenger := newTestMessenger(t)
+	messenger.save("alice", "testuser", "", "first")
+	messenger.save("bob", "testuser", "", "second")
+	messenger.save("carol", "testuser", "", "third")
+	messenger.save("carol", "otheruser", "", "not yours")
+	sent := runInboxCommand(messenger, "delete", "1")
+	if 1 != len(sent) || "testuser 1 messages deleted" != sent[0] {
+		t.Error("message not deleted")
+	}
+	sent = runInboxCommand(messenger, "clear", "")
+	if 1 != len(sent) || "testuser 2 messages deleted" != sent[0] {
+		t.Error("inbox not cleared")
+	}
+	pending, _ := messenger.store.pending("testuser")
+	if 0 != len(pending) {
+		t.Error("messages left after clear")
+	}
+	pending, _ = messenger.store.pending("otheruser")
+	if 1 != len(pending) {
+		t.Error("message of other user deleted")
+	}
+}
+
+// inbox is only available as direct message
+func Test_offlineMessenger_inboxCommand_3(t *testing.T) {
+	t.Parallel()
+	messenger := newTestMessenger(t)
+	messenger.save("alice", "testuser", "", "secret")
+	con := &recordingSender{}
+	cmd := &command{name: "read", args: "1", nick: "testuser", channel: "#foo"}
+	messenger.inboxCommand(cmd, con)
+	sent := con.sent()
+	if 1 != len(sent) || "#foo testuser: your inbox is private, send me \"read\" as direct message" != sent[0] {
+		t.Error("inbox used in channel")
+	}
+	messenger.inboxCommand(nil, con)
+	messenger.inboxCommand(cmd, nil)
+}
@@ -1,97 +1,147 @@
 package main
 
 import (
-	"database/sql"
 	"fmt"
-	_ "github.com/mattn/go-sqlite3"
 	"github.com/thoj/go-ircevent" // imported as "irc"
 	"log"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 )
 
-// Inital setup of database. Handle things as needed to reduce
-// false alarms.
-func initOfflineMessageDatabase(filename string) error {
-	if len(filename) == 0 {
-		return fmt.Errorf("empty filename given")
+// Number of messages delivered automatically unless configured otherwise.
+const defaultPushLimit = 5
+
+// Scopes of offline messages, see offlineMessenger.scope
+const (
+	scopeNetwork = "network" // delivered in any channel
+	scopeChannel = "channel" // delivered in the channel they were left in
+)
+
+// The offline messenger: leave messages for users which are not around
+// and deliver them once they show up. Bundles the state shared by the
+// commands and the delivery callbacks.
+type offlineMessenger struct {
+	store  messageStore
+	nicks  *nickMapper    // casemapping of nicks
+	roster *channelRoster // who is around
+	logger *log.Logger
+
+	// Pending messages are delivered automatically up to this count,
+	// recipients of more messages are pointed to their inbox instead.
+	// No limit if 0.
+	pushLimit int
+	// Messages are removed after this time, delivered or not.
+	// Kept forever if 0. See also janitor()
+	maxAge time.Duration
+	// Senders get a message when their message expired undelivered.
+	notifyExpired bool
+	// Limits on messages left, see checkQuota()
+	quota offlineQuota
+	// Channels monitored and their settings, see channelConfig
+	channels []channelConfig
+	// Messages left in a channel are delivered in any channel
+	// (scopeNetwork) or only in the channel they were left in
+	// (scopeChannel). Messages left as direct message are delivered
+	// anywhere.
+	scope string
+
+	// guards the settings above (changed by configure()) as well
+	// as the state below
+	mutex    sync.Mutex
+	reminded map[string]int // folded nick -> pending messages reminded of
+	// folded nick -> time "forgetme" was sent, see privacyCommand()
+	forgetRequests map[string]time.Time
+	// folded nick -> privacy command waiting for WHOIS
+	verifications map[string]*pendingVerification
+}
+
+// Create an offline messenger using store for messages, nicks for nick
+// comparison and roster to know who is around.
+func newOfflineMessenger(store messageStore, nicks *nickMapper, roster *channelRoster, logger *log.Logger) (*offlineMessenger, error) {
+	if store == nil {
+		return nil, fmt.Errorf("message store is nil")
 	}
-	db, err := sql.Open("sqlite3", filename)
+	if roster == nil {
+		return nil, fmt.Errorf("channel roster is nil")
+	}
+	if logger == nil {
+		return nil, fmt.Errorf("logger nil pointer")
+	}
+	return &offlineMessenger{
+		store:          store,
+		nicks:          nicks,
+		roster:         roster,
+		logger:         logger,
+		pushLimit:      defaultPushLimit,
+		scope:          scopeNetwork,
+		quota:          defaultOfflineQuota,
+		reminded:       make(map[string]int),
+		forgetRequests: make(map[string]time.Time),
+		verifications:  make(map[string]*pendingVerification),
+	}, nil
+}
+
+// Store a message for a target (user) together with the time and
+// the context (channel, empty for direct messages) it was left in.
+// Returns a *quotaError if the message exceeds the quota.
+// If saving fails, this fact is going to be logged (but not the message content)
+func (m *offlineMessenger) save(source, target, context, message string) error {
+	msg, err := m.newMessage(source, target, context, message)
 	if err != nil {
-		return fmt.Errorf("failed to open database file: " + err.Error())
+		return err
 	}
-	defer db.Close()
-	sql := `CREATE TABLE IF NOT EXISTS messages (target TEXT, source TEXT, content TEXT);`
-	_, err = db.Exec(sql)
+	return m.saveMessage(msg)
+}
+
+// Store a message created by newMessage() if the quota allows.
+func (m *offlineMessenger) saveMessage(msg *offlineMessage) error {
+	err := m.checkQuota(msg)
 	if err != nil {
-		return fmt.Errorf("failed to create database table: " + err.Error())
+		return err
 	}
-	return nil
+	return m.store.save(msg, nil)
 }
 
-// Store a message for a target (user). If saving fails, this fact
-// is going to be logged (but not the message content)
-func saveOfflineMessage(dbfile, source, target, message string) error {
+// Create a message with folded keys and the current time after
+// checking the parameters.
+func (m *offlineMessenger) newMessage(source, target, context, message string) (*offlineMessage, error) {
 	// sanity checks
-	if len(dbfile) == 0 {
-		return fmt.Errorf("empty database filename")
-	}
 	if len(source) == 0 {
-		return fmt.Errorf("source of zero-length")
+		return nil, fmt.Errorf("source of zero-length")
 	}
 	if 0 != strings.Count(source, " ") {
-		return fmt.Errorf("source not allowed to contain whitespace")
+		return nil, fmt.Errorf("source not allowed to contain whitespace")
 	}
 	if len(target) == 0 {
-		return fmt.Errorf("target of zero-length")
+		return nil, fmt.Errorf("target of zero-length")
 	}
 	if 0 != strings.Count(target, " ") {
-		return fmt.Errorf("target not allowed to contain whitespace")
+		return nil, fmt.Errorf("target not allowed to contain whitespace")
 	}
 	if len(message) == 0 {
-		return fmt.Errorf("message of zero lenght")
-	}
-
-	// prepare db
-	db, err := sql.Open("sqlite3", dbfile)
-	if err != nil {
-		return fmt.Errorf("failed to open database file: " + err.Error())
-	}
-	defer db.Close()
-	sql := `CREATE TABLE IF NOT EXISTS messages (target TEXT, source TEXT, content TEXT);`
-	_, err = db.Exec(sql)
-	if err != nil {
-		return fmt.Errorf("failed to create database table: " + err.Error())
+		return nil, fmt.Errorf("message of zero lenght")
 	}
 
-	// prepare transaction
-	tx, err := db.Begin()
-	if err != nil {
-		return fmt.Errorf("beginning transaction failed: " + err.Error())
-	}
-	stmt, err := tx.Prepare("INSERT INTO messages (target, source, content) VALUES (?, ?, ?)")
-	if err != nil {
-		log.Fatal(err)
-	}
-	defer stmt.Close()
-
-	// execute transaction
-	_, err = stmt.Exec(target, source, message)
-	if err != nil {
-		return fmt.Errorf("executing INSERT failed: " + err.Error())
-	}
-	err = tx.Commit()
-	if err != nil {
-		return fmt.Errorf("commiting to database failed: " + err.Error())
-	}
-	return nil
+	return &offlineMessage{
+		target:    target,
+		targetKey: m.nicks.fold(target),
+		source:    source,
+		sourceKey: m.nicks.fold(source),
+		content:   message,
+		created:   time.Now(),
+		context:   context,
+	}, nil
 }
 
-// Retrieve and deliver previously stored message for user.
-func deliverOfflineMessage(dbfile, user string, con *irc.Connection) error {
+// Retrieve and deliver previously stored messages for user. If there
+// are more than pushLimit, the user is reminded of the inbox instead
+// (once per number of messages). Messages for public delivery are sent
+// to the channel they were left in if user is there, all others
+// privately.
+func (m *offlineMessenger) deliver(user string, con ircSender) error {
 	// sanity checks
-	if len(dbfile) == 0 {
-		return fmt.Errorf("database filename is empty")
-	}
 	if len(user) == 0 {
 		return fmt.Errorf("user of zero-length")
 	}
@@ -102,92 +152,300 @@ func deliverOfflineMessage(dbfile, user string, con *irc.Connection) error {
 		return fmt.Errorf("connection pointer is nil")
 	}
 
-	// prepare db
-	db, err := sql.Open("sqlite3", dbfile)
+	key := m.nicks.fold(user)
+	settings := m.settings()
+	var messages []offlineMessage
+	var err error
+	if scopeChannel == settings.scope {
+		messages, err = m.store.pending(key)
+		messages = m.inScope(user, messages)
+	} else if 0 < settings.pushLimit {
+		messages, err = m.store.pending(key)
+	}
 	if err != nil {
-		return fmt.Errorf("failed to open database file: " + err.Error())
+		return err
+	}
+	if 0 < settings.pushLimit && len(messages) > settings.pushLimit {
+		if m.remind(key, len(messages)) {
+			con.Privmsg(user, "you have "+strconv.Itoa(len(messages))+" messages waiting, send me \"inbox\" to read them")
+		}
+		return nil
 	}
-	defer db.Close()
 
-	// query db
-	rows, err := db.Query("SELECT source, content FROM messages WHERE target = ?", user)
+	if scopeChannel == settings.scope {
+		messages, err = m.claim(key, messages, time.Now())
+	} else {
+		messages, err = m.store.takePending(key, time.Now(), nil)
+	}
 	if err != nil {
-		return fmt.Errorf("query failed: " + err.Error())
+		return err
+	}
+	for _, msg := range messages {
+		if m.publicDelivery(&msg) && m.roster.inChannel(msg.context, user) {
+			con.Privmsg(msg.context, formatPublicMessage(user, &msg))
+			continue
+		}
+		con.Privmsg(user, formatOfflineMessage(&msg))
 	}
-	defer rows.Close()
+	m.remind(key, 0)
+	return nil
+}
 
-	// process retrieved information
-	source := ""
-	message := ""
-	for rows.Next() {
-		rows.Scan(&source, &message)
-		con.Privmsg(user, "message from "+source+": "+message+"\n")
+// Pick the messages which may be delivered to user right now: messages
+// left as direct message and messages left in a channel user is in.
+func (m *offlineMessenger) inScope(user string, messages []offlineMessage) []offlineMessage {
+	selected := []offlineMessage{}
+	for _, msg := range messages {
+		if 0 == len(msg.context) || m.roster.inChannel(msg.context, user) {
+			selected = append(selected, msg)
+		}
 	}
+	return selected
+}
 
-	// delete this message from db if needed
-	if (len(source) != 0) && (len(message) != 0) {
-		_, err = db.Exec("DELETE FROM messages WHERE target = ? AND source = ?", user, source)
+// Mark messages of key as delivered one by one. Returns the messages
+// marked, i.e. the ones not delivered in the meantime.
+func (m *offlineMessenger) claim(key string, messages []offlineMessage, now time.Time) ([]offlineMessage, error) {
+	claimed := []offlineMessage{}
+	for _, msg := range messages {
+		marked, err := m.store.markDelivered(key, []int64{msg.id}, now)
 		if err != nil {
-			return fmt.Errorf("executing DELETE failed: " + err.Error())
+			return claimed, err
+		}
+		if 1 == marked {
+			msg.delivered = now
+			claimed = append(claimed, msg)
 		}
 	}
+	return claimed, nil
+}
 
+// Take over settings and channels, also while running.
+func (m *offlineMessenger) configure(settings offlineSettings, channels []channelConfig) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.pushLimit = settings.pushLimit
+	m.maxAge = settings.maxAge
+	m.notifyExpired = settings.notifyExpired
+	m.quota = settings.quota
+	m.scope = settings.scope
+	m.channels = channels
+}
+
+// The current settings.
+func (m *offlineMessenger) settings() offlineSettings {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return offlineSettings{
+		pushLimit:     m.pushLimit,
+		maxAge:        m.maxAge,
+		notifyExpired: m.notifyExpired,
+		quota:         m.quota,
+		scope:         m.scope,
+	}
+}
+
+// Find the settings of a channel monitored. Returns nil for other
+// channels.
+func (m *offlineMessenger) channelSettings(channel string) *channelConfig {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	for i := range m.channels {
+		if m.nicks.equal(m.channels[i].name, channel) {
+			return &m.channels[i]
+		}
+	}
 	return nil
 }
 
+// Report if offline messages are enabled in a channel.
+func (m *offlineMessenger) enabledIn(channel string) bool {
+	settings := m.channelSettings(channel)
+	return settings != nil && settings.offlineMessages
+}
+
+// Report if a message left in context (a channel or empty) would be
+// delivered to nick right now: nick is in the channel with channel
+// scope, in any channel with offline messages enabled otherwise.
+func (m *offlineMessenger) reachable(nick, context string) bool {
+	if 0 < len(context) && scopeChannel == m.settings().scope {
+		return m.roster.inChannel(context, nick)
+	}
+	return m.enabledAround(nick)
+}
+
+// Report if nick is in a channel with offline messages enabled.
+func (m *offlineMessenger) enabledAround(nick string) bool {
+	for _, channel := range m.roster.channelsOf(nick) {
+		if m.enabledIn(channel) {
+			return true
+		}
+	}
+	return false
+}
+
+// Note that a user was told about count pending messages. Reports if
+// this is news, i.e. the user wasn't already reminded of that count.
+func (m *offlineMessenger) remind(key string, count int) bool {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if count == m.reminded[key] {
+		return false
+	}
+	if 0 == count {
+		delete(m.reminded, key)
+	} else {
+		m.reminded[key] = count
+	}
+	return true
+}
+
+// Render a message for delivery.
+func formatOfflineMessage(msg *offlineMessage) string {
+	delivered := msg.delivered
+	if delivered.IsZero() {
+		delivered = time.Now()
+	}
+	age := formatAge(msg.created, delivered)
+	return "message from " + msg.source + " (" + age + "): " + msg.content + "\n"
+}
+
+// Render a message for delivery in a channel, addressed to user.
+func formatPublicMessage(user string, msg *offlineMessage) string {
+	delivered := msg.delivered
+	if delivered.IsZero() {
+		delivered = time.Now()
+	}
+	return user + ": " + msg.source + " said (" + formatAge(msg.created, delivered) + "): " + msg.content
+}
+
+// Report if msg is to be delivered in public: it was left with ptell
+// or in a channel configured for public delivery.
+func (m *offlineMessenger) publicDelivery(msg *offlineMessage) bool {
+	if 0 == len(msg.context) {
+		return false
+	}
+	if msg.public {
+		return true
+	}
+	settings := m.channelSettings(msg.context)
+	return settings != nil && settings.publicDelivery
+}
+
+// Describe how long ago something happened in words,
+// e.g. "just now", "1 hour ago" or "3 days ago".
+func formatAge(then, now time.Time) string {
+	age := now.Sub(then)
+	count := 0
+	unit := ""
+	switch {
+	case age < time.Minute:
+		return "just now"
+	case age < time.Hour:
+		count, unit = int(age/time.Minute), "minute"
+	case age < 24*time.Hour:
+		count, unit = int(age/time.Hour), "hour"
+	default:
+		count, unit = int(age/(24*time.Hour)), "day"
+	}
+	if 1 != count {
+		unit += "s"
+	}
+	return strconv.Itoa(count) + " " + unit + " ago"
+}
+
 // Implements the offline messenger command to deliver messages to other upon JOIN.
-// To be in used as a callback for PRIVMSG.
-// mress command: tell <nick>: <message>
-// See also offlineMessengerDrone()
-func offlineMessengerCommand(e *irc.Event, irc *irc.Connection, user, dbfile string, logger *log.Logger) {
+// To be registered with the command router as "tell" and "ptell". The
+// sender gets a reply telling if the message was saved or what went
+// wrong. Messages are not stored for nicks they would be delivered to
+// right now. Messages left with ptell are delivered in the channel they
+// were left in.
+// mress commands: tell <nick>: <message>, ptell <nick>: <message>
+// See also drone()
+func (m *offlineMessenger) tellCommand(cmd *command, irc ircSender) {
 	// sanity checks
-	if e == nil {
+	if cmd == nil {
 		return
 	}
 	if irc == nil {
 		return
 	}
-	if len(user) == 0 {
+	if !cmd.direct() && !m.enabledIn(cmd.channel) {
+		cmd.reply(irc, "offline messages are disabled in "+cmd.channel)
 		return
 	}
-	if len(dbfile) == 0 {
+	public := "ptell" == cmd.name
+	if public && cmd.direct() {
+		cmd.reply(irc, "ptell delivers in the channel the message was left in, use it in a channel")
 		return
 	}
-	if logger == nil {
+	// detect "<nick>: <message>" -> reject anything else
+	separator := strings.Index(cmd.args, ":")
+	if 0 > separator {
+		cmd.reply(irc, "usage: "+cmd.name+" <nick>: <message>")
 		return
 	}
-	// ignore OTR
-	if 0 == strings.Index(e.Message(), "?OTR") {
+	target := strings.TrimSpace(cmd.args[:separator])
+	message := strings.TrimSpace(cmd.args[separator+1:])
+	if len(target) == 0 {
+		cmd.reply(irc, "whom should I tell? usage: "+cmd.name+" <nick>: <message>")
 		return
 	}
-	// reject non-direct messages
-	if user != e.Arguments[0] {
+	if 0 <= strings.IndexFunc(target, isSpace) {
+		cmd.reply(irc, "nicks can't contain spaces: "+target)
 		return
 	}
-	// detect command -> reject non-command
-	if 0 != strings.Index(e.Message(), "tell ") {
+	if len(message) == 0 {
+		cmd.reply(irc, "what should I tell "+target+"?")
 		return
 	}
-	if 5 > strings.Index(e.Message(), ":") {
+	if m.reachable(target, cmd.channel) {
+		cmd.reply(irc, target+" is here, no need to leave a message")
 		return
 	}
 
 	// store the message
-	target := strings.Fields(e.Message())[1]
-	target = strings.Trim(target, ":")
-	msgstart := strings.Index(e.Message(), ":") + 1
-	err := saveOfflineMessage(dbfile, e.Nick, target, e.Message()[msgstart:])
+	msg, err := m.newMessage(cmd.nick, target, cmd.channel, message)
+	if err == nil {
+		msg.public = public
+		err = m.saveMessage(msg)
+	}
+	if quota, ok := err.(*quotaError); ok {
+		m.logger.Println("offline message rejected by quota")
+		cmd.reply(irc, "sorry, "+quota.Error())
+		return
+	}
 	if err != nil {
-		logger.Println("offline message command failed")
-		logger.Println(err.Error())
+		m.logger.Println("offline message command failed")
+		m.logger.Println(err.Error())
+		cmd.reply(irc, "sorry, saving your message failed")
+		return
 	}
-	logger.Println("offline message saved")
+	m.logger.Println("offline message saved")
+	if m.publicDelivery(msg) {
+		cmd.reply(irc, "I'll tell "+target+" here when they join")
+		return
+	}
+	cmd.reply(irc, "I'll tell "+target+" when they join")
+}
+
+// Update the roster with an event first, then deliver messages (see
+// drone()), so deliveries see who just joined or changed the nick.
+// To be used as a callback for 353, JOIN, PART, KICK, QUIT, NICK and
+// PRIVMSG. self is the nick of mress.
+func (m *offlineMessenger) track(e *irc.Event, irc ircSender, self string) {
+	m.roster.handleEvent(e, self)
+	m.drone(e, irc, self)
 }
 
-// Deliver a message from a database. To be used as a callback for JOIN.
+// Deliver a message from a database. To be used (via track()) for JOIN,
+// 353 (names list), NICK and PRIVMSG, so messages are delivered as soon
+// as the recipient joins, is already there, changes to the nick the
+// messages are for or speaks up in a channel with offline messages
+// enabled. self is the nick of mress.
 // This implements the delivery part of the offline messenger command.
-// See also offlineMessengerCommand()
-func offlineMessengerDrone(e *irc.Event, irc *irc.Connection, dbfile, user, channel string, logger *log.Logger) {
+// See also tellCommand()
+func (m *offlineMessenger) drone(e *irc.Event, irc ircSender, self string) {
 	// sanity checks
 	if e == nil {
 		return
@@ -195,49 +453,55 @@ func offlineMessengerDrone(e *irc.Event, irc *irc.Connection, dbfile, user, chan
 	if irc == nil {
 		return
 	}
-	if len(dbfile) == 0 {
-		return
-	}
-	if len(user) == 0 {
-		return
-	}
-	if len(channel) == 0 {
-		return
-	}
-	if logger == nil {
+	if len(self) == 0 {
 		return
 	}
 
-	// check for being a callback for an event intended
-	// JOIN and 353 (names list)
-	if !((e.Code == "JOIN") || (e.Code == "353")) {
-		return
-	}
-	// ignore OTR -> potentially dead code?
+	// ignore OTR
 	if 0 == strings.Index(e.Message(), "?OTR") {
 		return
 	}
 
-	// TODO: handle self-join: if mress enters channel, deliver messages
-	// 353 hf_testbot2 @ #ircscribble :hf_testbot2 tzugh @herr_flupke\r\n
-	if e.Code == "353" {
+	recipients := []string{}
+	switch e.Code {
+	case "JOIN":
+		// others joining
+		if len(e.Arguments) == 0 || !m.enabledIn(e.Arguments[0]) {
+			return
+		}
+		recipients = append(recipients, e.Nick)
+	case "353":
+		// TODO: handle self-join: if mress enters channel, deliver messages
+		// 353 hf_testbot2 @ #ircscribble :hf_testbot2 tzugh @herr_flupke\r\n
 		// e.Nick is empty for 353
-		// strip "@" from op name
-		nickline := strings.Replace(e.Message(), "@", "", -1)
-		nicklist := strings.Fields(nickline)
-		for i := 0; i < len(nicklist); i++ {
-			err := deliverOfflineMessage(dbfile, nicklist[i], irc)
-			if err != nil {
-				logger.Println("delivering stale messages had problems")
-				logger.Println(err.Error())
-			}
+		if len(e.Arguments) < 2 || !m.enabledIn(e.Arguments[len(e.Arguments)-2]) {
+			return
+		}
+		for _, nick := range strings.Fields(e.Message()) {
+			recipients = append(recipients, stripNickPrefix(nick))
 		}
+	case "NICK":
+		// someone already around takes the nick messages are for
+		// NICK :newnick
+		if len(e.Arguments) == 0 || m.nicks.equal(self, e.Message()) || !m.enabledAround(e.Message()) {
+			return
+		}
+		recipients = append(recipients, e.Message())
+	case "PRIVMSG":
+		// someone speaks up in the channel
+		if len(e.Arguments) == 0 || !m.enabledIn(e.Arguments[0]) {
+			return
+		}
+		recipients = append(recipients, e.Nick)
+	default:
 		return
 	}
-	// handle others joining
-	err := deliverOfflineMessage(dbfile, e.Nick, irc)
-	if err != nil {
-		logger.Println("message delivery had problems")
-		logger.Println(err.Error())
+
+	for _, recipient := range recipients {
+		err := m.deliver(recipient, irc)
+		if err != nil {
+			m.logger.Println("message delivery had problems")
+			m.logger.Println(err.Error())
+		}
 	}
 }
@@ -1,264 +1,527 @@
 package main
 
 import (
-	"database/sql"
-	_ "github.com/mattn/go-sqlite3"
 	"github.com/thoj/go-ircevent"
-	"os"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
 )
 
-// test db initialization
-func Test_initOfflineMessageDatabase_0(t *testing.T) {
-	err := initOfflineMessageDatabase("testoffline.db")
+// offline messenger on an in-memory store for testing, monitoring #foo
+func newTestMessenger(t *testing.T) *offlineMessenger {
+	nicks := newNickMapper()
+	messenger, err := newOfflineMessenger(newMemoryMessageStore(), nicks, newChannelRoster(nicks), createLogger(""))
 	if err != nil {
-		t.Error(err.Error())
-	}
-	err = os.Remove("testoffline.db")
-	if nil != err {
-		t.Error(err.Error())
+		t.Fatal(err.Error())
 	}
+	messenger.channels = []channelConfig{{name: "#foo", offlineMessages: true}}
+	return messenger
 }
 
-func Test_initOfflineMessageDatabase_1(t *testing.T) {
-	err := initOfflineMessageDatabase("")
-	if err == nil {
-		t.Error("empty filename did not yield error")
+func Test_newOfflineMessenger_0(t *testing.T) {
+	t.Parallel()
+	store := newMemoryMessageStore()
+	roster := newChannelRoster(nil)
+	logger := createLogger("")
+	if _, err := newOfflineMessenger(nil, nil, roster, logger); err == nil {
+		t.Error("nil message store not detected")
+	}
+	if _, err := newOfflineMessenger(store, nil, nil, logger); err == nil {
+		t.Error("nil roster not detected")
+	}
+	if _, err := newOfflineMessenger(store, nil, roster, nil); err == nil {
+		t.Error("nil logger not detected")
+	}
+	messenger, err := newOfflineMessenger(store, nil, roster, logger)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if defaultPushLimit != messenger.pushLimit {
+		t.Error("push limit not set to default")
 	}
 }
 
 // valid transaction
-func Test_saveOfflineMessage_0(t *testing.T) {
-	dbfile := "testmsg.db"
-	err := saveOfflineMessage(dbfile, "testsource", "testtarget", "testmessage")
+func Test_offlineMessenger_save_0(t *testing.T) {
+	t.Parallel()
+	messenger := newTestMessenger(t)
+	err := messenger.save("testsource", "testtarget", "", "testmessage")
 	if err != nil {
 		t.Error(err.Error())
 	}
-	err = os.Remove(dbfile)
-	if nil != err {
-		t.Error(err.Error())
-	}
 }
 
 // empty target
-func Test_saveOfflineMessage_1(t *testing.T) {
-	dbfile := "testmsg.db"
-	err := initOfflineMessageDatabase(dbfile)
-	if err != nil {
-		t.Error(err.Error())
-	}
-	err = saveOfflineMessage(dbfile, "testsource", "", "testmessage")
+func Test_offlineMessenger_save_1(t *testing.T) {
+	t.Parallel()
+	messenger := newTestMessenger(t)
+	err := messenger.save("testsource", "", "", "testmessage")
 	if err == nil {
 		t.Error("empty target not detected")
 	}
-	err = os.Remove(dbfile)
-	if nil != err {
-		t.Error(err.Error())
-	}
 }
 
 // target with space
-func Test_saveOfflineMessage_2(t *testing.T) {
-	dbfile := "testmsg.db"
-	err := initOfflineMessageDatabase(dbfile)
-	if err != nil {
-		t.Error(err.Error())
-	}
-	err = saveOfflineMessage(dbfile, "testsource", "test target", "testmessage")
+func Test_offlineMessenger_save_2(t *testing.T) {
+	t.Parallel()
+	messenger := newTestMessenger(t)
+	err := messenger.save("testsource", "test target", "", "testmessage")
 	if err == nil {
 		t.Error("target with space not detected")
 	}
-	err = os.Remove(dbfile)
-	if nil != err {
-		t.Error(err.Error())
-	}
 }
 
 // emtpy message
-func Test_saveOfflineMessage_3(t *testing.T) {
-	dbfile := "testmsg.db"
-	err := initOfflineMessageDatabase(dbfile)
-	if err != nil {
-		t.Error(err.Error())
-	}
-	err = saveOfflineMessage(dbfile, "testsource", "testtarget", "")
+func Test_offlineMessenger_save_3(t *testing.T) {
+	t.Parallel()
+	messenger := newTestMessenger(t)
+	err := messenger.save("testsource", "testtarget", "", "")
 	if err == nil {
 		t.Error("empty message not detected")
 	}
-	err = os.Remove(dbfile)
-	if nil != err {
-		t.Error(err.Error())
-	}
 }
 
 // empty source
-func Test_saveOfflineMessage_4(t *testing.T) {
-	dbfile := "testmsg.db"
-	err := initOfflineMessageDatabase(dbfile)
-	if err != nil {
-		t.Error(err.Error())
-	}
-	err = saveOfflineMessage(dbfile, "", "testtarget", "testmessage")
+func Test_offlineMessenger_save_4(t *testing.T) {
+	t.Parallel()
+	messenger := newTestMessenger(t)
+	err := messenger.save("", "testtarget", "", "testmessage")
 	if err == nil {
 		t.Error("empty source not detected")
 	}
-	err = os.Remove(dbfile)
-	if nil != err {
-		t.Error(err.Error())
-	}
 }
 
 // source with space
-func Test_saveOfflineMessage_5(t *testing.T) {
-	dbfile := "testmsg.db"
-	err := initOfflineMessageDatabase(dbfile)
-	if err != nil {
-		t.Error(err.Error())
-	}
-	err = saveOfflineMessage(dbfile, "test source", "testtarget", "testmessage")
+func Test_offlineMessenger_save_5(t *testing.T) {
+	t.Parallel()
+	messenger := newTestMessenger(t)
+	err := messenger.save("test source", "testtarget", "", "testmessage")
 	if err == nil {
 		t.Error("source with space not detected")
 	}
-	err = os.Remove(dbfile)
-	if nil != err {
-		t.Error(err.Error())
-	}
 }
 
-// empty db filename
-func Test_saveOfflineMessage_6(t *testing.T) {
-	dbfile := ""
-	err := saveOfflineMessage(dbfile, "test source", "testtarget", "testmessage")
-	if err == nil {
-		t.Error("empty database filename not detected")
-	}
-}
-
-func Test_deliverOfflineMessage_0(t *testing.T) {
-	// prepare db
-	dbfile := "testmsg.db"
-	db, err := sql.Open("sqlite3", dbfile)
+// nicks are matched case insensitively
+func Test_offlineMessenger_save_6(t *testing.T) {
+	t.Parallel()
+	messenger := newTestMessenger(t)
+	err := messenger.save("Alice", "Bob", "", "hello")
 	if err != nil {
-		t.Error("failed to open database file: " + err.Error())
+		t.Fatal(err.Error())
 	}
-	defer db.Close()
-	sql := `CREATE TABLE IF NOT EXISTS messages (target TEXT, source TEXT, content TEXT);`
-	_, err = db.Exec(sql)
+	messages, err := messenger.store.takePending(messenger.nicks.fold("bOB"), time.Now(), nil)
 	if err != nil {
-		t.Error("failed to create database table: " + err.Error())
+		t.Fatal(err.Error())
+	}
+	if 1 != len(messages) {
+		t.Fatal("message not found case insensitively")
+	}
+	if "alice" != messages[0].sourceKey {
+		t.Error("source not folded")
 	}
+}
 
-	con := &irc.Connection{}
-	err = deliverOfflineMessage(dbfile, "testuser", con)
+func Test_offlineMessenger_deliver_0(t *testing.T) {
+	t.Parallel()
+	messenger := newTestMessenger(t)
+	con := &recordingSender{}
+	err := messenger.deliver("testuser", con)
 	if err != nil {
 		t.Log("valid call failed")
 		t.Error(err.Error())
 	}
-
-	os.Remove(dbfile)
+	if 0 != len(con.sent()) {
+		t.Error("message sent without any stored")
+	}
 }
 
-func Test_deliverOfflineMessage_1(t *testing.T) {
-	dbfile := "testmsg.db"
-	con := &irc.Connection{}
-	err := deliverOfflineMessage(dbfile, "test user", con)
+func Test_offlineMessenger_deliver_1(t *testing.T) {
+	t.Parallel()
+	messenger := newTestMessenger(t)
+	con := &recordingSender{}
+	err := messenger.deliver("test user", con)
 	if err == nil {
 		t.Log("username with spaces shouldn't be accepted")
 	}
-
-	os.Remove(dbfile)
 }
 
-func Test_deliverOfflineMessage_2(t *testing.T) {
-	dbfile := "testmsg.db"
-	con := &irc.Connection{}
-	err := deliverOfflineMessage(dbfile, "", con)
+func Test_offlineMessenger_deliver_2(t *testing.T) {
+	t.Parallel()
+	messenger := newTestMessenger(t)
+	con := &recordingSender{}
+	err := messenger.deliver("", con)
 	if err == nil {
 		t.Log("empty username shouldn't be accepted")
 	}
-	os.Remove(dbfile)
 }
 
-func Test_deliverOfflineMessage_3(t *testing.T) {
-	dbfile := ""
-	con := &irc.Connection{}
-	err := deliverOfflineMessage(dbfile, "testuser", con)
+func Test_offlineMessenger_deliver_3(t *testing.T) {
+	t.Parallel()
+	messenger := newTestMessenger(t)
+	err := messenger.deliver("testuser", nil)
 	if err == nil {
 		t.Log("nil connection pointer shouldn't be accepted")
 	}
-	os.Remove(dbfile)
 }
 
-func Test_deliverOfflineMessage_4(t *testing.T) {
-	dbfile := "testmsg.db"
-	err := deliverOfflineMessage(dbfile, "testuser", nil)
-	if err == nil {
-		t.Log("nil connection pointer shouldn't be accepted")
+// messages are delivered once
+func Test_offlineMessenger_deliver_4(t *testing.T) {
+	t.Parallel()
+	messenger := newTestMessenger(t)
+	con := &recordingSender{}
+	messenger.save("alice", "testuser", "", "first")
+	messenger.save("bob", "testuser", "", "second")
+	messenger.deliver("TestUser", con)
+	messenger.deliver("testuser", con)
+	sent := con.sent()
+	if 2 != len(sent) {
+		t.Fatal("wrong number of messages delivered")
+	}
+	if "TestUser message from alice (just now): first\n" != sent[0] {
+		t.Error("wrong message delivered: " + sent[0])
+	}
+}
+
+// too many messages are kept in the inbox, the recipient is reminded once
+func Test_offlineMessenger_deliver_5(t *testing.T) {
+	t.Parallel()
+	messenger := newTestMessenger(t)
+	messenger.pushLimit = 2
+	con := &recordingSender{}
+	for i := 0; i < 3; i++ {
+		messenger.save("alice", "testuser", "", "message "+strconv.Itoa(i))
+	}
+	messenger.deliver("testuser", con)
+	messenger.deliver("testuser", con)
+	sent := con.sent()
+	if 1 != len(sent) || "testuser you have 3 messages waiting, send me \"inbox\" to read them" != sent[0] {
+		t.Error("no (single) reminder sent")
+	}
+	pending, _ := messenger.store.pending("testuser")
+	if 3 != len(pending) {
+		t.Error("messages delivered despite push limit")
+	}
+
+	messenger.pushLimit = 0
+	messenger.deliver("testuser", con)
+	if 4 != len(con.sent()) {
+		t.Error("messages not delivered without push limit")
 	}
-	os.Remove(dbfile)
 }
 
 // callbacks shouldn't explode
-func Test_offlineMessengerCommand_0(t *testing.T) {
-	dbfile := "testmsg.db"
-	args := []string{"bla bla foo bar baz"}
-	event := &irc.Event{Arguments: args}
-	con := &irc.Connection{}
-	logger := createLogger("")
-	offlineMessengerCommand(event, con, "testuser", dbfile, logger)
-	os.Remove(dbfile)
+func Test_offlineMessenger_tellCommand_0(t *testing.T) {
+	t.Parallel()
+	messenger := newTestMessenger(t)
+	cmd := &command{name: "tell", args: "testtarget: foo bar baz", nick: "testsource"}
+	con := &recordingSender{}
+	messenger.tellCommand(nil, con)
+	messenger.tellCommand(cmd, nil)
+	if 0 != len(con.sent()) {
+		t.Error("reply sent for broken call")
+	}
 }
 
-func Test_offlineMessengerCommand_1(t *testing.T) {
-	dbfile := "testmsg.db"
-	con := &irc.Connection{}
-	logger := createLogger("")
-	offlineMessengerCommand(nil, con, "testuser", dbfile, logger)
-	os.Remove(dbfile)
+// message saved and confirmed
+func Test_offlineMessenger_tellCommand_1(t *testing.T) {
+	t.Parallel()
+	messenger := newTestMessenger(t)
+	cmd := &command{name: "tell", args: "testtarget: foo bar baz", nick: "testsource"}
+	con := &recordingSender{}
+	messenger.tellCommand(cmd, con)
+	sent := con.sent()
+	if 1 != len(sent) || "testsource I'll tell testtarget when they join" != sent[0] {
+		t.Error("no confirmation sent")
+	}
+	messages, _ := messenger.store.takePending("testtarget", time.Now(), nil)
+	if 1 != len(messages) || "foo bar baz" != messages[0].content {
+		t.Error("message not saved")
+	}
 }
 
-func Test_offlineMessengerCommand_2(t *testing.T) {
-	dbfile := "testmsg.db"
-	args := []string{"bla bla foo bar baz"}
-	event := &irc.Event{Arguments: args}
-	logger := createLogger("")
-	offlineMessengerCommand(event, nil, "testuser", dbfile, logger)
-	os.Remove(dbfile)
+// broken commands are explained, nothing is saved
+func Test_offlineMessenger_tellCommand_2(t *testing.T) {
+	t.Parallel()
+	replies := map[string]string{
+		"bla bla foo bar baz":   "testsource usage: tell <nick>: <message>",
+		": foo bar baz":         "testsource whom should I tell? usage: tell <nick>: <message>",
+		"test target: foo":      "testsource nicks can't contain spaces: test target",
+		"testtarget:   ":        "testsource what should I tell testtarget?",
+		"here: you are already": "testsource here is here, no need to leave a message",
+	}
+	for args, reply := range replies {
+		messenger := newTestMessenger(t)
+		messenger.roster.handleEvent(&irc.Event{Code: "JOIN", Nick: "Here", Arguments: []string{"#foo"}}, "mress")
+		cmd := &command{name: "tell", args: args, nick: "testsource"}
+		con := &recordingSender{}
+		messenger.tellCommand(cmd, con)
+		sent := con.sent()
+		if 1 != len(sent) || reply != sent[0] {
+			t.Error("wrong reply for '" + args + "'")
+		}
+		for _, target := range []string{"", "test", "testtarget", "here"} {
+			messages, _ := messenger.store.pending(target)
+			if 0 != len(messages) {
+				t.Error("message saved for '" + args + "'")
+			}
+		}
+	}
 }
 
-func Test_offlineMessengerCommand_3(t *testing.T) {
-	dbfile := "testmsg.db"
-	args := []string{"bla bla foo bar baz"}
-	event := &irc.Event{Arguments: args}
-	con := &irc.Connection{}
-	logger := createLogger("")
-	offlineMessengerCommand(event, con, "test user", dbfile, logger)
-	os.Remove(dbfile)
+// replies in channel are addressed to the sender
+func Test_offlineMessenger_tellCommand_3(t *testing.T) {
+	t.Parallel()
+	messenger := newTestMessenger(t)
+	cmd := &command{name: "tell", args: "testtarget: hi", nick: "testsource", channel: "#foo"}
+	con := &recordingSender{}
+	messenger.tellCommand(cmd, con)
+	sent := con.sent()
+	if 1 != len(sent) || "#foo testsource: I'll tell testtarget when they join" != sent[0] {
+		t.Error("confirmation not addressed to sender")
+	}
 }
 
-func Test_offlineMessengerCommand_4(t *testing.T) {
-	dbfile := "testmsg.db"
-	args := []string{"bla bla foo bar baz"}
-	event := &irc.Event{Arguments: args}
-	con := &irc.Connection{}
-	logger := createLogger("")
-	offlineMessengerCommand(event, con, "", dbfile, logger)
-	os.Remove(dbfile)
+func Test_formatAge_0(t *testing.T) {
+	t.Parallel()
+	now := time.Now()
+	ages := map[time.Duration]string{
+		10 * time.Second:    "just now",
+		1 * time.Minute:     "1 minute ago",
+		150 * time.Second:   "2 minutes ago",
+		5 * time.Hour:       "5 hours ago",
+		24 * time.Hour:      "1 day ago",
+		3*24*time.Hour + 60: "3 days ago",
+	}
+	for age, expected := range ages {
+		formatted := formatAge(now.Add(-age), now)
+		if expected != formatted {
+			t.Error("wrong age: " + formatted + " instead of " + expected)
+		}
+	}
 }
 
-func Test_offlineMessengerCommand_5(t *testing.T) {
-	dbfile := "testmsg.db"
-	args := []string{"bla bla foo bar baz"}
-	event := &irc.Event{Arguments: args}
-	con := &irc.Connection{}
-	offlineMessengerCommand(event, con, "testuser", dbfile, nil)
-	os.Remove(dbfile)
+// drone shouldn't explode
+func Test_offlineMessenger_drone_0(t *testing.T) {
+	t.Parallel()
+	messenger := newTestMessenger(t)
+	con := &recordingSender{}
+	event := &irc.Event{Code: "NICK", Nick: "bob_away", Arguments: []string{"bob"}}
+	messenger.drone(nil, con, "mress")
+	messenger.drone(event, nil, "mress")
+	messenger.drone(event, con, "")
+	// nothing to deliver
+	messenger.drone(event, con, "mress")
+	if 0 != len(con.sent()) {
+		t.Error("message sent without any stored")
+	}
 }
 
-func Test_offlineMessengerCommand_6(t *testing.T) {
-	dbfile := ""
-	args := []string{"bla bla foo bar baz"}
-	event := &irc.Event{Arguments: args}
-	con := &irc.Connection{}
-	offlineMessengerCommand(event, con, "testuser", dbfile, nil)
+// events not concerning the recipient leave messages alone
+func Test_offlineMessenger_drone_1(t *testing.T) {
+	t.Parallel()
+	messenger := newTestMessenger(t)
+	con := &recordingSender{}
+	messenger.save("alice", "bob", "", "hello")
+	events := []*irc.Event{
+		{Code: "NICK", Nick: "bob", Arguments: []string{"bob_away"}},
+		{Code: "PRIVMSG", Nick: "bob", Arguments: []string{"#bar", "hi"}},
+		{Code: "PRIVMSG", Nick: "carol", Arguments: []string{"#foo", "hi"}},
+		{Code: "PART", Nick: "bob", Arguments: []string{"#foo"}},
+		{Code: "NICK", Nick: "bob_away"},
+	}
+	for _, event := range events {
+		messenger.drone(event, con, "mress")
+	}
+	messages, err := messenger.store.pending("bob")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if 1 != len(messages) {
+		t.Error("message delivered on unrelated event")
+	}
+}
+
+// messages get delivered on join, names list, nick change and speaking up
+// (the roster sees the events first)
+func Test_offlineMessenger_drone_2(t *testing.T) {
+	t.Parallel()
+	events := []*irc.Event{
+		{Code: "JOIN", Nick: "Bob", Arguments: []string{"#foo"}},
+		{Code: "353", Arguments: []string{"mress", "=", "#foo", "mress @Bob"}},
+		{Code: "NICK", Nick: "bob_away", Arguments: []string{"Bob"}},
+		{Code: "PRIVMSG", Nick: "Bob", Arguments: []string{"#FOO", "hi"}},
+	}
+	for _, event := range events {
+		messenger := newTestMessenger(t)
+		con := &recordingSender{}
+		messenger.save("alice", "bob", "", "hello")
+		messenger.roster.add("#foo", "bob_away")
+		messenger.track(event, con, "mress")
+		sent := con.sent()
+		if 1 != len(sent) || "Bob message from alice (just now): hello\n" != sent[0] {
+			t.Error("message not delivered on " + event.Code)
+		}
+	}
+}
+
+// ptell only works in a channel
+func Test_offlineMessenger_tellCommand_5(t *testing.T) {
+	t.Parallel()
+	messenger := newTestMessenger(t)
+	con := &recordingSender{}
+	messenger.tellCommand(&command{name: "ptell", args: "bob: hello", nick: "alice"}, con)
+	if count, _ := messenger.store.countPending(); 0 != count {
+		t.Error("ptell saved as direct message")
+	}
+	messenger.tellCommand(&command{name: "ptell", args: "bob: hello", nick: "alice", channel: "#foo"}, con)
+	sent := con.sent()
+	if "#foo alice: I'll tell bob here when they join" != sent[len(sent)-1] {
+		t.Error("wrong reply: " + sent[len(sent)-1])
+	}
+	pending, _ := messenger.store.pending("bob")
+	if 1 != len(pending) || !pending[0].public || "#foo" != pending[0].context {
+		t.Error("message not saved for public delivery")
+	}
+}
+
+// public delivery only in the channel the message was left in
+func Test_offlineMessenger_deliver_public_0(t *testing.T) {
+	t.Parallel()
+	messenger := newTestMessenger(t)
+	messenger.channels = append(messenger.channels, channelConfig{name: "#bar", offlineMessages: true})
+	messenger.tellCommand(&command{name: "ptell", args: "bob: in foo", nick: "alice", channel: "#foo"}, &recordingSender{})
+	messenger.tellCommand(&command{name: "ptell", args: "bob: in bar", nick: "alice", channel: "#bar"}, &recordingSender{})
+	messenger.save("alice", "bob", "#foo", "private")
+	messenger.roster.add("#Foo", "Bob")
+	con := &recordingSender{}
+	messenger.deliver("Bob", con)
+	sent := con.sent()
+	if 3 != len(sent) {
+		t.Fatal("wrong number of messages delivered")
+	}
+	if "#foo Bob: alice said (just now): in foo" != sent[0] {
+		t.Error("not delivered in public: " + sent[0])
+	}
+	if "Bob message from alice (just now): in bar\n" != sent[1] {
+		t.Error("delivered in public outside of the channel: " + sent[1])
+	}
+	if "Bob message from alice (just now): private\n" != sent[2] {
+		t.Error("tell delivered in public: " + sent[2])
+	}
+}
+
+// channels configured for public delivery
+func Test_offlineMessenger_deliver_public_1(t *testing.T) {
+	t.Parallel()
+	messenger := newTestMessenger(t)
+	messenger.channels[0].publicDelivery = true
+	messenger.save("alice", "bob", "#foo", "in foo")
+	messenger.save("alice", "bob", "", "direct")
+	messenger.roster.add("#foo", "bob")
+	con := &recordingSender{}
+	messenger.deliver("bob", con)
+	sent := con.sent()
+	if 2 != len(sent) || "#foo bob: alice said (just now): in foo" != sent[0] || "bob message from alice (just now): direct\n" != sent[1] {
+		t.Error("wrong delivery: " + strings.Join(sent, "|"))
+	}
+}
+
+// no offline messages in channels where they are disabled
+func Test_offlineMessenger_tellCommand_6(t *testing.T) {
+	t.Parallel()
+	messenger := newTestMessenger(t)
+	messenger.channels = append(messenger.channels, channelConfig{name: "#bar"})
+	con := &recordingSender{}
+	messenger.tellCommand(&command{name: "tell", args: "bob: hello", nick: "alice", channel: "#bar"}, con)
+	messenger.tellCommand(&command{name: "tell", args: "bob: hello", nick: "alice", channel: "#baz"}, con)
+	sent := con.sent()
+	if 2 != len(sent) || "#bar alice: offline messages are disabled in #bar" != sent[0] {
+		t.Error("wrong reply: " + strings.Join(sent, "|"))
+	}
+	if count, _ := messenger.store.countPending(); 0 != count {
+		t.Error("message saved in disabled channel")
+	}
+	messenger.save("alice", "bob", "", "hello")
+	messenger.drone(&irc.Event{Code: "JOIN", Nick: "bob", Arguments: []string{"#bar"}}, con, "mress")
+	if count, _ := messenger.store.countPending(); 1 != count {
+		t.Error("message delivered in disabled channel")
+	}
+}
+
+// messages stay in the channel they were left in with channel scope
+func Test_offlineMessenger_deliver_scope_0(t *testing.T) {
+	t.Parallel()
+	messenger := newTestMessenger(t)
+	messenger.scope = scopeChannel
+	messenger.channels = append(messenger.channels, channelConfig{name: "#bar", offlineMessages: true})
+	messenger.save("alice", "bob", "#foo", "in foo")
+	messenger.save("alice", "bob", "#bar", "in bar")
+	messenger.save("alice", "bob", "", "direct")
+	messenger.roster.add("#bar", "bob")
+	con := &recordingSender{}
+	messenger.drone(&irc.Event{Code: "JOIN", Nick: "bob", Arguments: []string{"#bar"}}, con, "mress")
+	sent := con.sent()
+	if 2 != len(sent) || "bob message from alice (just now): in bar\n" != sent[0] || "bob message from alice (just now): direct\n" != sent[1] {
+		t.Fatal("wrong delivery: " + strings.Join(sent, "|"))
+	}
+	pending, _ := messenger.store.pending("bob")
+	if 1 != len(pending) || "in foo" != pending[0].content {
+		t.Fatal("message of other channel delivered")
+	}
+	messenger.roster.add("#foo", "bob")
+	messenger.drone(&irc.Event{Code: "PRIVMSG", Nick: "bob", Arguments: []string{"#foo", "hi"}}, con, "mress")
+	if pending, _ = messenger.store.pending("bob"); 0 != len(pending) {
+		t.Error("message not delivered in its channel")
+	}
+}
+
+// nick changes only deliver in channels with offline messages enabled
+func Test_offlineMessenger_drone_3(t *testing.T) {
+	t.Parallel()
+	messenger := newTestMessenger(t)
+	messenger.channels = append(messenger.channels, channelConfig{name: "#bar"})
+	messenger.save("alice", "bob", "", "hello")
+	con := &recordingSender{}
+	messenger.track(&irc.Event{Code: "JOIN", Nick: "bob_away", Arguments: []string{"#bar"}}, con, "mress")
+	messenger.track(&irc.Event{Code: "NICK", Nick: "bob_away", Arguments: []string{"bob"}}, con, "mress")
+	messenger.track(&irc.Event{Code: "NICK", Nick: "carol", Arguments: []string{"bob"}}, con, "mress")
+	if 0 != len(con.sent()) {
+		t.Fatal("delivered outside of channels with offline messages: " + strings.Join(con.sent(), "|"))
+	}
+	messenger.track(&irc.Event{Code: "JOIN", Nick: "bob", Arguments: []string{"#foo"}}, con, "mress")
+	if 1 != len(con.sent()) {
+		t.Error("not delivered on join: " + strings.Join(con.sent(), "|"))
+	}
+}
+
+// messages are left for nicks only in channels without delivery, no
+// other channel is named
+func Test_offlineMessenger_tellCommand_7(t *testing.T) {
+	t.Parallel()
+	messenger := newTestMessenger(t)
+	messenger.channels = append(messenger.channels, channelConfig{name: "#bar", offlineMessages: true})
+	messenger.roster.add("#secret", "bob")
+	con := &recordingSender{}
+	messenger.tellCommand(&command{name: "tell", args: "bob: hi", nick: "alice", channel: "#foo"}, con)
+	sent := con.sent()
+	if 1 != len(sent) || "#foo alice: I'll tell bob when they join" != sent[0] {
+		t.Error("wrong reply: " + strings.Join(sent, "|"))
+	}
+	messenger.roster.add("#bar", "bob")
+	messenger.tellCommand(&command{name: "tell", args: "bob: hi", nick: "alice", channel: "#foo"}, con)
+	if sent = con.sent(); 2 != len(sent) || "#foo alice: bob is here, no need to leave a message" != sent[1] {
+		t.Error("wrong reply: " + strings.Join(sent, "|"))
+	}
+	// with channel scope only the channel itself counts
+	messenger.scope = scopeChannel
+	messenger.tellCommand(&command{name: "tell", args: "bob: hi", nick: "alice", channel: "#foo"}, con)
+	if sent = con.sent(); 3 != len(sent) || "#foo alice: I'll tell bob when they join" != sent[2] {
+		t.Error("wrong reply: " + strings.Join(sent, "|"))
+	}
+	for _, reply := range sent {
+		if strings.Contains(reply, "#secret") || strings.Contains(reply, "#bar") {
+			t.Error("channel named: " + reply)
+		}
+	}
 }
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Implements the outbox commands to review and retract messages left
+// with tell which are not delivered yet. To be registered with the
+// command router as "outbox" and "untell". The outbox is only
+// available as direct message.
+// mress commands: outbox, untell <id|nick>
+func (m *offlineMessenger) outboxCommand(cmd *command, irc ircSender) {
+	// sanity checks
+	if cmd == nil {
+		return
+	}
+	if irc == nil {
+		return
+	}
+	if "outbox" == cmd.name && !cmd.direct() {
+		cmd.reply(irc, "your outbox is private, send me \"outbox\" as direct message")
+		return
+	}
+
+	key := m.nicks.fold(cmd.nick)
+	outgoing, err := m.store.outgoing(key)
+	if err != nil {
+		m.logger.Println("reading outbox failed")
+		m.logger.Println(err.Error())
+		cmd.reply(irc, "sorry, reading your outbox failed")
+		return
+	}
+
+	switch cmd.name {
+	case "outbox":
+		if 0 == len(outgoing) {
+			cmd.reply(irc, "your outbox is empty")
+			return
+		}
+		cmd.reply(irc, strconv.Itoa(len(outgoing))+" messages not delivered yet, \"untell <id>\" or \"untell <nick>\" takes them back")
+		now := time.Now()
+		for _, msg := range outgoing {
+			cmd.reply(irc, strconv.FormatInt(msg.id, 10)+": to "+msg.target+" ("+formatAge(msg.created, now)+"): "+msg.content)
+		}
+	case "untell":
+		which := strings.TrimSpace(cmd.args)
+		if len(which) == 0 {
+			cmd.reply(irc, "usage: untell <id|nick>, see \"outbox\" for the ids")
+			return
+		}
+		ids := []int64{}
+		if id, err := strconv.ParseInt(which, 10, 64); err == nil {
+			// nicks don't start with a digit
+			ids = append(ids, id)
+		} else {
+			for _, msg := range outgoing {
+				if m.nicks.equal(which, msg.target) {
+					ids = append(ids, msg.id)
+				}
+			}
+		}
+		retracted, err := m.store.retract(key, ids)
+		if err != nil {
+			m.logger.Println("retracting messages failed")
+			m.logger.Println(err.Error())
+			cmd.reply(irc, "sorry, taking back your messages failed")
+			return
+		}
+		if 0 == retracted {
+			cmd.reply(irc, "no undelivered message for "+which+" in your outbox")
+			return
+		}
+		cmd.reply(irc, strconv.Itoa(retracted)+" messages taken back")
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+// run an outbox command as direct message, return the replies
+func runOutboxCommand(messenger *offlineMessenger, name, args string) []string {
+	con := &recordingSender{}
+	cmd := &command{name: name, args: args, nick: "alice"}
+	messenger.outboxCommand(cmd, con)
+	return con.sent()
+}
+
+func Test_offlineMessenger_outboxCommand_0(t *testing.T) {
+	t.Parallel()
+	messenger := newTestMessenger(t)
+	sent := runOutboxCommand(messenger, "outbox", "")
+	if 1 != len(sent) || "alice your outbox is empty" != sent[0] {
+		t.Error("empty outbox not reported")
+	}
+	messenger.save("alice", "bob", "", "first")
+	messenger.save("carol", "bob", "", "not yours")
+	messenger.save("alice", "dave", "", "second")
+	messenger.store.takePending("dave", time.Now(), nil)
+	sent = runOutboxCommand(messenger, "outbox", "")
+	if 2 != len(sent) {
+		t.Fatal("wrong number of replies")
+	}
+	if "alice 1: to bob (just now): first" != sent[1] {
+		t.Error("wrong listing: " + sent[1])
+	}
+}
+
+// untell by id and by nick, only own undelivered messages
+func Test_offlineMessenger_outboxCommand_1(t *testing.T) {
+	t.Parallel()
+	messenger := newTestMessenger(t)
+	messenger.save("alice", "bob", "", "first")
+	messenger.save("alice", "Bob", "", "second")
+	messenger.save("carol", "bob", "", "not yours")
+	messenger.save("alice", "dave", "", "third")
+	outgoing, _ := messenger.store.outgoing("carol")
+	sent := runOutboxCommand(messenger, "untell", strconv.FormatInt(outgoing[0].id, 10))
+	if 1 != len(sent) || "alice no undelivered message for "+strconv.FormatInt(outgoing[0].id, 10)+" in your outbox" != sent[0] {
+		t.Error("message of other sender taken back")
+	}
+	sent = runOutboxCommand(messenger, "untell", "BOB")
+	if 1 != len(sent) || "alice 2 messages taken back" != sent[0] {
+		t.Error("messages not taken back by nick")
+	}
+	outgoing, _ = messenger.store.outgoing("alice")
+	if 1 != len(outgoing) || "third" != outgoing[0].content {
+		t.Error("wrong messages left")
+	}
+	sent = runOutboxCommand(messenger, "untell", strconv.FormatInt(outgoing[0].id, 10))
+	if 1 != len(sent) || "alice 1 messages taken back" != sent[0] {
+		t.Error("message not taken back by id")
+	}
+	pending, _ := messenger.store.pending("bob")
+	if 1 != len(pending) || "carol" != pending[0].source {
+		t.Error("message of other sender lost")
+	}
+	sent = runOutboxCommand(messenger, "untell", "")
+	if 1 != len(sent) {
+		t.Error("missing argument not reported")
+	}
+}
+
+// outbox is only available as direct message
+func Test_offlineMessenger_outboxCommand_2(t *testing.T) {
+	t.Parallel()
+	messenger := newTestMessenger(t)
+	messenger.save("alice", "bob", "", "secret")
+	con := &recordingSender{}
+	cmd := &command{name: "outbox", nick: "alice", channel: "#foo"}
+	messenger.outboxCommand(cmd, con)
+	sent := con.sent()
+	if 1 != len(sent) || "#foo alice: your outbox is private, send me \"outbox\" as direct message" != sent[0] {
+		t.Error("outbox used in channel")
+	}
+	messenger.outboxCommand(nil, con)
+	messenger.outboxCommand(cmd, nil)
+}
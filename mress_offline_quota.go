@@ -0,0 +1,73 @@
+package main
+
+import (
+	"strconv"
+	"unicode/utf8"
+)
+
+// Limits on offline messages to keep the database (and the inbox of
+// recipients) from growing without bound. 0 means no limit.
+type offlineQuota struct {
+	perSender    int // undelivered messages left by one sender
+	perRecipient int // undelivered messages waiting for one recipient
+	total        int // undelivered messages overall, of all networks
+	maxLength    int // characters per message
+}
+
+// Limits used unless configured otherwise.
+var defaultOfflineQuota = offlineQuota{
+	perSender:    20,
+	perRecipient: 50,
+	total:        10000,
+	maxLength:    400,
+}
+
+// A message was rejected because a quota is exhausted. The error
+// message is meant for the sender.
+type quotaError struct {
+	reason string
+}
+
+func (e *quotaError) Error() string {
+	return e.reason
+}
+
+// Check if msg may be stored without exceeding the quota.
+// Returns a *quotaError if a limit is hit.
+func (m *offlineMessenger) checkQuota(msg *offlineMessage) error {
+	quota := m.settings().quota
+	if 0 < quota.maxLength {
+		length := utf8.RuneCountInString(msg.content)
+		if length > quota.maxLength {
+			return &quotaError{"your message is too long (" + strconv.Itoa(length) + " characters, at most " + strconv.Itoa(quota.maxLength) + " allowed)"}
+		}
+	}
+	if 0 < quota.perSender {
+		outgoing, err := m.store.outgoing(msg.sourceKey)
+		if err != nil {
+			return err
+		}
+		if len(outgoing) >= quota.perSender {
+			return &quotaError{"you already left " + strconv.Itoa(len(outgoing)) + " undelivered messages, take some back with \"untell\" first"}
+		}
+	}
+	if 0 < quota.perRecipient {
+		pending, err := m.store.pending(msg.targetKey)
+		if err != nil {
+			return err
+		}
+		if len(pending) >= quota.perRecipient {
+			return &quotaError{msg.target + " already has " + strconv.Itoa(len(pending)) + " messages waiting, try again later"}
+		}
+	}
+	if 0 < quota.total {
+		count, err := m.store.countPending()
+		if err != nil {
+			return err
+		}
+		if count >= quota.total {
+			return &quotaError{"I can't take any more messages right now, try again later"}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// no limits, no rejections
+func Test_offlineMessenger_checkQuota_0(t *testing.T) {
+	t.Parallel()
+	messenger := newTestMessenger(t)
+	messenger.quota = offlineQuota{}
+	for i := 0; i < 100; i++ {
+		if err := messenger.save("alice", "bob", "", strings.Repeat("x", 1000)); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+}
+
+// every limit is enforced on its own
+func Test_offlineMessenger_checkQuota_1(t *testing.T) {
+	t.Parallel()
+	quotas := map[string]offlineQuota{
+		"per sender":    {perSender: 2},
+		"per recipient": {perRecipient: 2},
+		"total":         {total: 2},
+	}
+	for name, quota := range quotas {
+		messenger := newTestMessenger(t)
+		messenger.quota = quota
+		messenger.save("alice", "bob", "", "one")
+		messenger.save("alice", "bob", "", "two")
+		err := messenger.save("alice", "bob", "", "three")
+		if _, ok := err.(*quotaError); !ok {
+			t.Error(name + ": limit not enforced")
+		}
+	}
+}
+
+// limits apply to undelivered messages of the sender or recipient only
+func Test_offlineMessenger_checkQuota_2(t *testing.T) {
+	t.Parallel()
+	messenger := newTestMessenger(t)
+	messenger.quota = offlineQuota{perSender: 1, perRecipient: 1}
+	if err := messenger.save("alice", "bob", "", "one"); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := messenger.save("carol", "dave", "", "two"); err != nil {
+		t.Error("limit of others applied")
+	}
+	messenger.store.takePending("bob", time.Now(), nil)
+	if err := messenger.save("Alice", "Bob", "", "three"); err != nil {
+		t.Error("delivered messages counted")
+	}
+}
+
+func Test_offlineMessenger_checkQuota_3(t *testing.T) {
+	t.Parallel()
+	messenger := newTestMessenger(t)
+	messenger.quota = offlineQuota{maxLength: 5}
+	if err := messenger.save("alice", "bob", "", "äöüßé"); err != nil {
+		t.Error("length not counted in characters")
+	}
+	if _, ok := messenger.save("alice", "bob", "", "sixsix").(*quotaError); !ok {
+		t.Error("long message not rejected")
+	}
+}
+
+// the sender is told which limit was hit
+func Test_offlineMessenger_tellCommand_4(t *testing.T) {
+	t.Parallel()
+	messenger := newTestMessenger(t)
+	messenger.quota = offlineQuota{perRecipient: 1}
+	messenger.save("carol", "bob", "", "first")
+	con := &recordingSender{}
+	messenger.tellCommand(&command{name: "tell", args: "bob: hello", nick: "alice"}, con)
+	sent := con.sent()
+	if 1 != len(sent) || "alice sorry, bob already has 1 messages waiting, try again later" != sent[0] {
+		t.Error("wrong reply: " + strings.Join(sent, "|"))
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// How often the janitor looks for expired messages.
+const janitorInterval = time.Hour
+
+// Parse the maximum age of messages. Accepts Go durations ("36h") and
+// days ("30d"). "0" or "" means messages are kept forever.
+func parseMaxAge(age string) (time.Duration, error) {
+	age = strings.TrimSpace(age)
+	if len(age) == 0 || "0" == age {
+		return 0, nil
+	}
+	var maxAge time.Duration
+	if strings.HasSuffix(age, "d") {
+		days, err := strconv.Atoi(strings.TrimSuffix(age, "d"))
+		if err != nil {
+			return 0, fmt.Errorf("invalid number of days: " + age)
+		}
+		maxAge = time.Duration(days) * 24 * time.Hour
+	} else {
+		var err error
+		maxAge, err = time.ParseDuration(age)
+		if err != nil {
+			return 0, fmt.Errorf("invalid maximum age: " + age)
+		}
+	}
+	if maxAge < 0 {
+		return 0, fmt.Errorf("negative maximum age: " + age)
+	}
+	return maxAge, nil
+}
+
+// Remove messages older than maxAge, delivered or not. If notifyExpired
+// is set, senders of undelivered messages get an offline message from
+// mress (self) about it, marked as notice. Returns the number of undelivered messages
+// expired.
+func (m *offlineMessenger) expire(self string, now time.Time) (int, error) {
+	settings := m.settings()
+	if 0 == settings.maxAge {
+		return 0, nil
+	}
+	expired, err := m.store.expire(now.Add(-settings.maxAge))
+	if err != nil {
+		return 0, err
+	}
+	if !settings.notifyExpired {
+		return len(expired), nil
+	}
+	for _, msg := range expired {
+		if msg.notice {
+			// don't notify about notifications
+			continue
+		}
+		notice := "your message to " + msg.target + " from " + formatAge(msg.created, now) + " expired undelivered"
+		// notifications are not subject to the quota
+		notification, err := m.newMessage(self, msg.source, "", notice)
+		if err == nil {
+			notification.notice = true
+			err = m.store.save(notification, nil)
+		}
+		if err != nil {
+			m.logger.Println("saving expiry notification failed")
+			m.logger.Println(err.Error())
+		}
+	}
+	return len(expired), nil
+}
+
+// Expire old messages right away and then every janitorInterval,
+// until stop is closed. Closes done when finished. Keeps running
+// without maxAge, it may be configured later.
+// self returns the current nick of mress, used as sender of notifications.
+func (m *offlineMessenger) janitor(self func() string, stop <-chan struct{}, done chan<- struct{}) {
+	defer close(done)
+	ticker := time.NewTicker(janitorInterval)
+	defer ticker.Stop()
+	for {
+		count, err := m.expire(self(), time.Now())
+		if err != nil {
+			m.logger.Println("expiring offline messages failed")
+			m.logger.Println(err.Error())
+		} else if 0 < count {
+			m.logger.Println("expired " + strconv.Itoa(count) + " undelivered offline messages")
+		}
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
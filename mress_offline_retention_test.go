@@ -0,0 +1,137 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func Test_parseMaxAge_0(t *testing.T) {
+	t.Parallel()
+	valid := map[string]time.Duration{
+		"":     0,
+		"0":    0,
+		"30d":  30 * 24 * time.Hour,
+		" 1d ": 24 * time.Hour,
+		"12h":  12 * time.Hour,
+	}
+	for age, expected := range valid {
+		maxAge, err := parseMaxAge(age)
+		if err != nil {
+			t.Error("rejected valid age '" + age + "'")
+		}
+		if expected != maxAge {
+			t.Error("wrong duration for '" + age + "': " + maxAge.String())
+		}
+	}
+	for _, age := range []string{"d", "xd", "-1d", "-3h", "month"} {
+		if _, err := parseMaxAge(age); err == nil {
+			t.Error("accepted invalid age '" + age + "'")
+		}
+	}
+}
+
+// nothing expires without a maximum age
+func Test_offlineMessenger_expire_0(t *testing.T) {
+	t.Parallel()
+	messenger := newTestMessenger(t)
+	messenger.save("alice", "bob", "", "hello")
+	count, err := messenger.expire("mress", time.Now().Add(365*24*time.Hour))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if 0 != count {
+		t.Error("message expired without maximum age")
+	}
+}
+
+// senders are notified about expired messages, but mress is not
+func Test_offlineMessenger_expire_1(t *testing.T) {
+	t.Parallel()
+	messenger := newTestMessenger(t)
+	messenger.maxAge = 24 * time.Hour
+	messenger.notifyExpired = true
+	messenger.save("alice", "Bob", "", "hello")
+	later := time.Now().Add(48 * time.Hour)
+	count, err := messenger.expire("mress", later)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if 1 != count {
+		t.Fatal("message not expired")
+	}
+	if pending, _ := messenger.store.pending("bob"); 0 != len(pending) {
+		t.Error("expired message still pending")
+	}
+	pending, _ := messenger.store.pending("alice")
+	if 1 != len(pending) {
+		t.Fatal("sender not notified")
+	}
+	if "mress" != pending[0].source {
+		t.Error("notification not from mress")
+	}
+	if "your message to Bob from 2 days ago expired undelivered" != pending[0].content {
+		t.Error("wrong notification: " + pending[0].content)
+	}
+
+	// expiring the notification does not notify mress
+	count, _ = messenger.expire("mress", later.Add(48*time.Hour))
+	if 1 != count {
+		t.Error("notification not expired")
+	}
+	if pending, _ = messenger.store.pending("mress"); 0 != len(pending) {
+		t.Error("mress notified about its own message")
+	}
+}
+
+// notifications stored under a fallback nick of mress are recognised
+func Test_offlineMessenger_expire_3(t *testing.T) {
+	t.Parallel()
+	messenger := newTestMessenger(t)
+	messenger.store = openTestStore(t)
+	messenger.maxAge = 24 * time.Hour
+	messenger.notifyExpired = true
+	messenger.save("alice", "bob", "", "hello")
+	later := time.Now().Add(48 * time.Hour)
+	messenger.expire("mress_", later)
+	pending, _ := messenger.store.pending("alice")
+	if 1 != len(pending) || "mress_" != pending[0].source || !pending[0].notice {
+		t.Fatal("sender not notified by the fallback nick")
+	}
+
+	// mress got its nick back, the notification expires without another one
+	count, _ := messenger.expire("mress", later.Add(48*time.Hour))
+	if 1 != count {
+		t.Error("notification not expired")
+	}
+	if pending, _ = messenger.store.pending("mress_"); 0 != len(pending) {
+		t.Error("fallback nick notified about a notification")
+	}
+}
+
+// no notification unless configured
+func Test_offlineMessenger_expire_2(t *testing.T) {
+	t.Parallel()
+	messenger := newTestMessenger(t)
+	messenger.maxAge = time.Hour
+	messenger.save("alice", "bob", "", "hello")
+	messenger.expire("mress", time.Now().Add(2*time.Hour))
+	if pending, _ := messenger.store.pending("alice"); 0 != len(pending) {
+		t.Error("sender notified without being configured")
+	}
+}
+
+// the janitor stops when asked to
+func Test_offlineMessenger_janitor_0(t *testing.T) {
+	t.Parallel()
+	messenger := newTestMessenger(t)
+	messenger.maxAge = time.Hour
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go messenger.janitor(func() string { return "mress" }, stop, done)
+	close(stop)
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Error("janitor did not stop")
+	}
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"github.com/thoj/go-ircevent" // imported as "irc"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Time to confirm "forgetme".
+const forgetTimeout = 5 * time.Minute
+
+// Looks up which services account a nick is logged in to (WHOIS,
+// answered with RPL_WHOISACCOUNT). Implemented by *irc.Connection.
+type accountLookup interface {
+	Whois(nick string)
+}
+
+// A privacy command waiting for WHOIS to tell the account of its sender.
+type pendingVerification struct {
+	cmd     *command
+	con     ircSender
+	account string // empty unless logged in
+}
+
+// Implements the privacy commands: users get everything stored about
+// them and can have it removed. Only available as direct message and
+// only to users logged in to the services account of their nick, so
+// nobody gets or removes the data of a nick by just changing to it.
+// Actions are logged without content. To be registered with the
+// command router as "mydata" and "forgetme".
+// mress commands: mydata, forgetme [yes]
+func (m *offlineMessenger) privacyCommand(cmd *command, irc ircSender) {
+	// sanity checks
+	if cmd == nil {
+		return
+	}
+	if irc == nil {
+		return
+	}
+	if !cmd.direct() {
+		cmd.reply(irc, "your data is private, send me \""+cmd.name+"\" as direct message")
+		return
+	}
+	lookup, ok := irc.(accountLookup)
+	if !ok {
+		cmd.reply(irc, "sorry, I can't check who you are")
+		return
+	}
+	// continued by handleEndOfWhois()
+	m.mutex.Lock()
+	m.verifications[m.nicks.fold(cmd.nick)] = &pendingVerification{cmd: cmd, con: irc}
+	m.mutex.Unlock()
+	lookup.Whois(cmd.nick)
+}
+
+// Remember the account a nick is logged in to.
+// To be used as a callback for RPL_WHOISACCOUNT (330).
+func (m *offlineMessenger) handleWhoisAccount(e *irc.Event) {
+	// <me> <nick> <account> :is logged in as
+	if e == nil || 3 > len(e.Arguments) {
+		return
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if pending, found := m.verifications[m.nicks.fold(e.Arguments[1])]; found {
+		pending.account = e.Arguments[2]
+	}
+}
+
+// Run the privacy command waiting for WHOIS if its sender is logged in
+// to the account of the same name, refuse it otherwise.
+// To be used as a callback for RPL_ENDOFWHOIS (318).
+func (m *offlineMessenger) handleEndOfWhois(e *irc.Event) {
+	// <me> <nick> :End of WHOIS
+	if e == nil || 2 > len(e.Arguments) {
+		return
+	}
+	key := m.nicks.fold(e.Arguments[1])
+	m.mutex.Lock()
+	pending, found := m.verifications[key]
+	delete(m.verifications, key)
+	m.mutex.Unlock()
+	if !found {
+		return
+	}
+	cmd := pending.cmd
+	if !m.nicks.equal(cmd.nick, pending.account) {
+		m.logger.Println(cmd.name + ": refused, " + cmd.nick + " is not logged in to the account " + cmd.nick)
+		cmd.reply(pending.con, "only the owner of a registered nick can see or remove its data, identify with NickServ as "+cmd.nick+" first")
+		return
+	}
+	m.runPrivacyCommand(cmd, pending.con)
+}
+
+// Run a privacy command of a verified sender.
+func (m *offlineMessenger) runPrivacyCommand(cmd *command, irc ircSender) {
+	key := m.nicks.fold(cmd.nick)
+	switch cmd.name {
+	case "mydata":
+		messages, err := m.store.about(key)
+		if err != nil {
+			m.logger.Println("reading data of " + cmd.nick + " failed")
+			m.logger.Println(err.Error())
+			cmd.reply(irc, "sorry, reading your data failed")
+			return
+		}
+		m.logger.Println("mydata: sending " + strconv.Itoa(len(messages)) + " messages stored about " + cmd.nick)
+		if 0 == len(messages) {
+			cmd.reply(irc, "I have no messages from or to you stored")
+			return
+		}
+		cmd.reply(irc, "I have "+strconv.Itoa(len(messages))+" messages from or to you stored, \"forgetme\" removes them")
+		now := time.Now()
+		for _, msg := range messages {
+			cmd.reply(irc, formatStoredMessage(&msg, now))
+		}
+	case "forgetme":
+		if "yes" != strings.ToLower(strings.TrimSpace(cmd.args)) {
+			m.requestForget(key)
+			cmd.reply(irc, "this removes all messages from and to you, delivered or not. send me \"forgetme yes\" within "+strconv.Itoa(int(forgetTimeout/time.Minute))+" minutes to confirm")
+			return
+		}
+		if !m.confirmForget(key, time.Now()) {
+			cmd.reply(irc, "nothing to confirm, send me \"forgetme\" first")
+			return
+		}
+		removed, err := m.store.forget(key)
+		if err != nil {
+			m.logger.Println("forgetme: removing data of " + cmd.nick + " failed")
+			m.logger.Println(err.Error())
+			cmd.reply(irc, "sorry, removing your data failed")
+			return
+		}
+		m.remind(key, 0)
+		m.logger.Println("forgetme: removed " + strconv.Itoa(removed) + " messages stored about " + cmd.nick)
+		cmd.reply(irc, strconv.Itoa(removed)+" messages removed, I forgot about you")
+	}
+}
+
+// Note that key asked to be forgotten and has to confirm.
+func (m *offlineMessenger) requestForget(key string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.forgetRequests[key] = time.Now()
+}
+
+// Report if key asked to be forgotten within forgetTimeout before now.
+// The request is used up either way.
+func (m *offlineMessenger) confirmForget(key string, now time.Time) bool {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	requested, found := m.forgetRequests[key]
+	delete(m.forgetRequests, key)
+	return found && now.Sub(requested) <= forgetTimeout
+}
+
+// Render a stored message with all details for "mydata".
+func formatStoredMessage(msg *offlineMessage, now time.Time) string {
+	text := strconv.FormatInt(msg.id, 10) + ": from " + msg.source + " to " + msg.target
+	if 0 < len(msg.context) {
+		text += " in " + msg.context
+	}
+	text += ", left " + formatAge(msg.created, now)
+	if !msg.delivered.IsZero() {
+		// the content is dropped on delivery
+		return text + ", delivered " + formatAge(msg.delivered, now)
+	}
+	return text + ", not delivered: " + msg.content
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"github.com/thoj/go-ircevent" // imported as "irc"
+	"strings"
+	"testing"
+	"time"
+)
+
+// records messages and WHOIS lookups
+type recordingAccountLookup struct {
+	recordingSender
+}
+
+func (r *recordingAccountLookup) Whois(nick string) {
+	r.Privmsg("WHOIS", nick)
+}
+
+// run a privacy command, the server answers WHOIS with the account
+// (empty if not logged in)
+func runPrivacyTestCommand(messenger *offlineMessenger, cmd *command, con *recordingAccountLookup, account string) {
+	messenger.privacyCommand(cmd, con)
+	if 0 < len(account) {
+		messenger.handleWhoisAccount(&irc.Event{Code: "330", Arguments: []string{"mress", cmd.nick, account, "is logged in as"}})
+	}
+	messenger.handleEndOfWhois(&irc.Event{Code: "318", Arguments: []string{"mress", cmd.nick, "End of /WHOIS list."}})
+}
+
+// only as direct message
+func Test_offlineMessenger_privacyCommand_0(t *testing.T) {
+	t.Parallel()
+	messenger := newTestMessenger(t)
+	messenger.save("bob", "alice", "", "secret")
+	con := &recordingAccountLookup{}
+	runPrivacyTestCommand(messenger, &command{name: "mydata", nick: "alice", channel: "#foo"}, con, "alice")
+	sent := con.sent()
+	if 1 != len(sent) || strings.Contains(sent[0], "secret") {
+		t.Error("data shown in channel")
+	}
+	messenger.privacyCommand(nil, con)
+	messenger.privacyCommand(&command{name: "mydata", nick: "alice"}, nil)
+}
+
+// everything from and to the user, delivered or not
+func Test_offlineMessenger_privacyCommand_1(t *testing.T) {
+	t.Parallel()
+	messenger := newTestMessenger(t)
+	messenger.save("bob", "Alice", "#foo", "to alice")
+	messenger.save("alice", "carol", "", "from alice")
+	messenger.save("bob", "carol", "", "not about alice")
+	messenger.store.takePending("alice", time.Now(), nil)
+	con := &recordingAccountLookup{}
+	runPrivacyTestCommand(messenger, &command{name: "mydata", nick: "ALICE"}, con, "alice")
+	sent := con.sent()[1:]
+	if 3 != len(sent) {
+		t.Fatal("wrong number of replies: " + strings.Join(sent, "|"))
+	}
+	if !strings.HasSuffix(sent[1], ": from bob to Alice in #foo, left just now, delivered just now") {
+		t.Error("wrong details: " + sent[1])
+	}
+	if strings.Contains(sent[1], "to alice") {
+		t.Error("content of delivered message kept")
+	}
+	if !strings.HasSuffix(sent[2], ": from alice to carol, left just now, not delivered: from alice") {
+		t.Error("wrong details: " + sent[2])
+	}
+}
+
+// forgetting needs confirmation
+func Test_offlineMessenger_privacyCommand_2(t *testing.T) {
+	t.Parallel()
+	messenger := newTestMessenger(t)
+	messenger.save("bob", "alice", "", "to alice")
+	messenger.save("alice", "carol", "", "from alice")
+	messenger.save("bob", "carol", "", "not about alice")
+	con := &recordingAccountLookup{}
+	runPrivacyTestCommand(messenger, &command{name: "forgetme", args: "yes", nick: "alice"}, con, "alice")
+	if count, _ := messenger.store.countPending(); 3 != count {
+		t.Fatal("data removed without request")
+	}
+	runPrivacyTestCommand(messenger, &command{name: "forgetme", nick: "alice"}, con, "alice")
+	if count, _ := messenger.store.countPending(); 3 != count {
+		t.Fatal("data removed without confirmation")
+	}
+	runPrivacyTestCommand(messenger, &command{name: "forgetme", args: "yes", nick: "Alice"}, con, "alice")
+	if count, _ := messenger.store.countPending(); 1 != count {
+		t.Error("data not removed")
+	}
+	sent := con.sent()
+	if "Alice 2 messages removed, I forgot about you" != sent[len(sent)-1] {
+		t.Error("wrong reply: " + sent[len(sent)-1])
+	}
+}
+
+// confirmation times out and is used up
+func Test_offlineMessenger_confirmForget_0(t *testing.T) {
+	t.Parallel()
+	messenger := newTestMessenger(t)
+	messenger.requestForget("alice")
+	if messenger.confirmForget("alice", time.Now().Add(forgetTimeout+time.Minute)) {
+		t.Error("late confirmation accepted")
+	}
+	messenger.requestForget("alice")
+	if !messenger.confirmForget("alice", time.Now()) {
+		t.Error("confirmation not accepted")
+	}
+	if messenger.confirmForget("alice", time.Now()) {
+		t.Error("confirmation accepted twice")
+	}
+}
+
+// only for users logged in to the account of their nick
+func Test_offlineMessenger_privacyCommand_3(t *testing.T) {
+	t.Parallel()
+	messenger := newTestMessenger(t)
+	messenger.save("bob", "alice", "", "secret")
+	con := &recordingAccountLookup{}
+	runPrivacyTestCommand(messenger, &command{name: "mydata", nick: "alice"}, con, "")
+	runPrivacyTestCommand(messenger, &command{name: "mydata", nick: "alice"}, con, "mallory")
+	runPrivacyTestCommand(messenger, &command{name: "forgetme", nick: "alice"}, con, "mallory")
+	runPrivacyTestCommand(messenger, &command{name: "forgetme", args: "yes", nick: "alice"}, con, "mallory")
+	for _, line := range con.sent() {
+		if strings.Contains(line, "secret") || strings.Contains(line, "removed") {
+			t.Error("data of unverified user used: " + line)
+		}
+	}
+	if count, _ := messenger.store.countPending(); 1 != count {
+		t.Error("data of unverified user removed")
+	}
+	if "WHOIS alice" != con.sent()[0] || !strings.Contains(con.sent()[1], "identify with NickServ as alice") {
+		t.Error("wrong replies: " + strings.Join(con.sent(), "|"))
+	}
+	plain := &recordingSender{}
+	messenger.privacyCommand(&command{name: "mydata", nick: "alice"}, plain)
+	if sent := plain.sent(); 1 != len(sent) || strings.Contains(sent[0], "secret") {
+		t.Error("data sent without lookup")
+	}
+	messenger.handleEndOfWhois(&irc.Event{Code: "318", Arguments: []string{"mress", "carol", "End of /WHOIS list."}})
+	messenger.handleWhoisAccount(nil)
+	messenger.handleEndOfWhois(nil)
+}
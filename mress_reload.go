@@ -0,0 +1,193 @@
+package main
+
+import (
+	"log"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// Apply a reloaded config to the running networks: the log destination,
+// offline messaging settings, channels (joined and parted) and
+// max-retries change live, everything else is logged as taking effect
+// after a restart. Returns the config in effect now.
+func applyConfig(running, reloaded *Config, networks []*ircNetwork, logger *log.Logger) *Config {
+	effective := *running
+	restart := func(what string) {
+		logger.Println(what + ", takes effect after a restart")
+	}
+
+	if reloaded.logDestination != running.logDestination {
+		loggers := []*log.Logger{logger}
+		for _, network := range networks {
+			loggers = append(loggers, network.logger)
+		}
+		if switchLogDestination(reloaded.logDestination, loggers) {
+			effective.logDestination = reloaded.logDestination
+		}
+	}
+	if reloaded.dbfile != running.dbfile {
+		restart("database file changed")
+	}
+	if !reflect.DeepEqual(running.keys.ids(), reloaded.keys.ids()) || currentKey(running.keys) != currentKey(reloaded.keys) {
+		restart("encryption keys changed")
+	}
+	if reloaded.legacyNetwork != running.legacyNetwork {
+		restart("legacy-network changed")
+	}
+	if reloaded.offline != running.offline {
+		logger.Println("applying changed offline messaging settings")
+		effective.offline = reloaded.offline
+	}
+
+	// networks are matched by name
+	configs := make(map[string]networkConfig)
+	for _, config := range reloaded.networks {
+		configs[config.name] = config
+	}
+	effective.networks = []networkConfig{}
+	for _, network := range networks {
+		config, found := configs[network.config.name]
+		if !found {
+			restart("network " + network.config.name + " removed")
+		} else {
+			network.reconfigure(config, effective.offline)
+			delete(configs, config.name)
+		}
+		effective.networks = append(effective.networks, network.currentConfig())
+	}
+	added := []string{}
+	for name := range configs {
+		added = append(added, name)
+	}
+	sort.Strings(added)
+	for _, name := range added {
+		restart("network " + name + " added")
+	}
+	return &effective
+}
+
+// The id of the key encrypting new messages, empty without keys.
+func currentKey(keys *keyring) string {
+	if !keys.enabled() {
+		return ""
+	}
+	return keys.current
+}
+
+// Send the log of all loggers to a new destination (see createLogger).
+// Keeps the current destination if the new one can't be opened.
+// Reports if the destination changed.
+func switchLogDestination(destination string, loggers []*log.Logger) bool {
+	if 0 == len(loggers) {
+		return false
+	}
+	created := createLogger(destination)
+	if created == nil {
+		loggers[0].Println("opening log destination '" + destination + "' failed, keeping the current one")
+		return false
+	}
+	loggers[0].Println("logging to '" + destination + "' from now on")
+	old := loggers[0].Writer()
+	for _, logger := range loggers {
+		logger.SetOutput(created.Writer())
+	}
+	if file, ok := old.(*os.File); ok && file != os.Stdout && file != os.Stderr {
+		file.Close()
+	}
+	loggers[0].Println("log destination changed")
+	return true
+}
+
+// The settings of the network in effect.
+func (n *ircNetwork) currentConfig() networkConfig {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	config := n.config
+	config.channels = append([]channelConfig{}, n.config.channels...)
+	return config
+}
+
+// Take over changed settings while running: join channels added (after
+// NickServ confirmed the identification, see nickServ), part channels
+// removed, use the new channel and offline messaging settings
+// and max-retries. Changes of other settings are logged as taking
+// effect after a restart. Never logs passwords, only which settings
+// changed.
+func (n *ircNetwork) reconfigure(config networkConfig, settings offlineSettings) {
+	n.mutex.Lock()
+	old := n.config
+	n.config.channels = config.channels
+	n.config.maxRetries = config.maxRetries
+	joined := stateRegistered == n.state
+	n.mutex.Unlock()
+	n.messenger.configure(settings, config.channels)
+	// while NickServ holds back joining, done() joins the new channels
+	held := joined && n.nickserv.holdsJoins()
+	joined = joined && !held
+
+	if old.maxRetries != config.maxRetries {
+		n.logger.Println("max-retries changed")
+	}
+	changed := []string{}
+	for _, setting := range []struct {
+		name    string
+		changed bool
+	}{
+		{"server", old.server != config.server},
+		{"port", old.port != config.port},
+		{"use-tls", old.useTLS != config.useTLS},
+		{"nickname", old.nick != config.nick},
+		{"password", old.password != config.password},
+		{"TLS settings", !reflect.DeepEqual(old.tls, config.tls)},
+		{"SASL settings", old.sasl != config.sasl},
+		{"NickServ settings", old.nickserv != config.nickserv},
+	} {
+		if setting.changed {
+			changed = append(changed, setting.name)
+		}
+	}
+	if 0 < len(changed) {
+		n.logger.Println(strings.Join(changed, ", ") + " changed, takes effect after a restart")
+	}
+
+	// join and part
+	previous := make(map[string]channelConfig)
+	for _, channel := range old.channels {
+		previous[n.messenger.nicks.fold(channel.name)] = channel
+	}
+	for _, channel := range config.channels {
+		key := n.messenger.nicks.fold(channel.name)
+		before, found := previous[key]
+		delete(previous, key)
+		if found {
+			if before.key != channel.key {
+				n.logger.Println("key of " + channel.name + " changed, used on the next join")
+			}
+			continue
+		}
+		if held {
+			n.logger.Println("joining " + channel.name + " once identified with " + nickServName)
+			continue
+		}
+		n.logger.Println("joining " + channel.name)
+		if !joined {
+			continue
+		}
+		if 0 < len(channel.key) {
+			n.con.Join(channel.name + " " + channel.key)
+		} else {
+			n.con.Join(channel.name)
+		}
+	}
+	for _, channel := range old.channels {
+		if _, found := previous[n.messenger.nicks.fold(channel.name)]; !found {
+			continue
+		}
+		n.logger.Println("leaving " + channel.name)
+		if joined {
+			n.con.Part(channel.name)
+		}
+	}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// network logging into a buffer
+func newTestReloadNetwork(t *testing.T, config networkConfig) (*ircNetwork, *bytes.Buffer) {
+	var buffer bytes.Buffer
+	network, err := newNetwork(config, openTestDatabase(t), nil, offlineSettings{}, false, log.New(&buffer, "", 0))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	t.Cleanup(func() { network.store.close() })
+	return network, &buffer
+}
+
+// channels and max-retries change live, the rest after a restart
+func Test_ircNetwork_reconfigure_0(t *testing.T) {
+	t.Parallel()
+	config := networkConfig{name: "oftc", server: "irc.oftc.net", port: 6697, nick: "mress", password: "secret",
+		channels: []channelConfig{{name: "#old"}, {name: "#kept", key: "k1"}}}
+	network, buffer := newTestReloadNetwork(t, config)
+	changed := config
+	changed.port = 7000
+	changed.password = "n3wsecret"
+	changed.maxRetries = 4
+	changed.channels = []channelConfig{{name: "#KEPT", key: "k2"}, {name: "#new"}}
+	settings := offlineSettings{pushLimit: 5, scope: scopeChannel, quota: defaultOfflineQuota}
+	network.reconfigure(changed, settings)
+
+	current := network.currentConfig()
+	if 4 != current.maxRetries || 2 != len(current.channels) || "#new" != current.channels[1].name {
+		t.Error("channels or max-retries not changed")
+	}
+	if 7000 == current.port || "secret" != current.password {
+		t.Error("settings needing a restart changed")
+	}
+	if 5 != network.messenger.settings().pushLimit {
+		t.Error("offline messaging settings not applied")
+	}
+	logged := buffer.String()
+	for _, line := range []string{"joining #new", "leaving #old", "key of #KEPT changed", "max-retries changed",
+		"port, password changed, takes effect after a restart"} {
+		if !strings.Contains(logged, line) {
+			t.Error("'" + line + "' not logged")
+		}
+	}
+	if strings.Contains(logged, "leaving #kept") || strings.Contains(logged, "n3wsecret") {
+		t.Error("wrong log: " + logged)
+	}
+}
+
+// added channels are not joined while waiting for NickServ
+func Test_ircNetwork_reconfigure_1(t *testing.T) {
+	t.Parallel()
+	config := networkConfig{name: "oftc", server: "irc.oftc.net", port: 6697, nick: "mress",
+		channels: []channelConfig{{name: "#old"}}}
+	config.nickserv = nickServConfig{password: "n1ckserv", recover: recoverRegain}
+	network, buffer := newTestReloadNetwork(t, config)
+	network.setState(stateRegistered)
+	network.nickserv.wait()
+	defer network.nickserv.reset()
+	changed := config
+	changed.channels = []channelConfig{{name: "#old"}, {name: "#new"}}
+	network.reconfigure(changed, offlineSettings{})
+	if !strings.Contains(buffer.String(), "joining #new once identified with NickServ") {
+		t.Error("joined while waiting for NickServ: " + buffer.String())
+	}
+	if !network.nickserv.holdsJoins() {
+		t.Error("stopped waiting for NickServ")
+	}
+}
+
+// networks added and removed, restart needed for the database
+func Test_applyConfig_0(t *testing.T) {
+	t.Parallel()
+	config := networkConfig{name: "oftc", server: "irc.oftc.net", port: 6697, nick: "mress"}
+	network, _ := newTestReloadNetwork(t, config)
+	var buffer bytes.Buffer
+	logger := log.New(&buffer, "", 0)
+	running := &Config{dbfile: "old.db", networks: []networkConfig{config}}
+	changed := config
+	changed.channels = []channelConfig{{name: "#mress"}}
+	reloaded := &Config{dbfile: "new.db", networks: []networkConfig{{name: "libera"}, changed},
+		offline: offlineSettings{pushLimit: 2}}
+	effective := applyConfig(running, reloaded, []*ircNetwork{network}, logger)
+
+	if "old.db" != effective.dbfile || 2 != effective.offline.pushLimit {
+		t.Error("wrong effective config")
+	}
+	if 1 != len(effective.networks) || 1 != len(effective.networks[0].channels) {
+		t.Error("network not reconfigured")
+	}
+	logged := buffer.String()
+	for _, line := range []string{"database file changed, takes effect after a restart",
+		"network libera added, takes effect after a restart", "applying changed offline messaging settings"} {
+		if !strings.Contains(logged, line) {
+			t.Error("'" + line + "' not logged")
+		}
+	}
+	applyConfig(effective, &Config{dbfile: "old.db"}, []*ircNetwork{network}, logger)
+	if !strings.Contains(buffer.String(), "network oftc removed, takes effect after a restart") {
+		t.Error("removed network not logged")
+	}
+}
+
+func Test_switchLogDestination_0(t *testing.T) {
+	t.Parallel()
+	var buffer bytes.Buffer
+	root := log.New(&buffer, "", 0)
+	other := log.New(&buffer, "[oftc] ", 0)
+	if switchLogDestination("", nil) {
+		t.Error("switched without loggers")
+	}
+	broken := filepath.Join(t.TempDir(), "missing", "mress.log")
+	if switchLogDestination(broken, []*log.Logger{root, other}) {
+		t.Error("switched to unusable destination")
+	}
+	destination := filepath.Join(t.TempDir(), "mress.log")
+	if !switchLogDestination(destination, []*log.Logger{root, other}) {
+		t.Fatal("log destination not switched")
+	}
+	other.Println("after switching")
+	content, err := ioutil.ReadFile(destination)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if !strings.Contains(string(content), "[oftc] after switching") || strings.Contains(buffer.String(), "after switching") {
+		t.Error("logged to the old destination")
+	}
+	root.Writer().(*os.File).Close()
+}
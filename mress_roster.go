@@ -0,0 +1,144 @@
+package main
+
+import (
+	"github.com/thoj/go-ircevent" // imported as "irc"
+	"strings"
+	"sync"
+)
+
+// Keeps track of who is in the channels mress is in. Fed by NAMES
+// replies (353), JOIN, PART, KICK, QUIT and NICK. Nicks and channels
+// are compared according to the casemapping. Safe for concurrent use.
+type channelRoster struct {
+	mutex    sync.Mutex
+	nicks    *nickMapper
+	channels map[string]map[string]string // folded channel -> folded nick -> nick
+}
+
+// Create an empty roster using the casemapping of nicks.
+func newChannelRoster(nicks *nickMapper) *channelRoster {
+	return &channelRoster{
+		nicks:    nicks,
+		channels: make(map[string]map[string]string),
+	}
+}
+
+// Update the roster from an event of 353, JOIN, PART, KICK, QUIT and
+// NICK, before messages are delivered (see track()). self is the nick
+// of mress.
+func (r *channelRoster) handleEvent(e *irc.Event, self string) {
+	// sanity checks
+	if e == nil {
+		return
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	switch e.Code {
+	case "353":
+		// 353 mress = #foo :mress tzugh @herr_flupke
+		if len(e.Arguments) < 2 {
+			return
+		}
+		channel := e.Arguments[len(e.Arguments)-2]
+		for _, nick := range strings.Fields(e.Message()) {
+			r.add(channel, stripNickPrefix(nick))
+		}
+	case "JOIN":
+		if len(e.Arguments) == 0 {
+			return
+		}
+		if r.nicks.equal(self, e.Nick) {
+			// fresh start, NAMES follows
+			delete(r.channels, r.nicks.fold(e.Arguments[0]))
+		}
+		r.add(e.Arguments[0], e.Nick)
+	case "PART":
+		if len(e.Arguments) == 0 {
+			return
+		}
+		r.remove(e.Arguments[0], e.Nick, self)
+	case "KICK":
+		// KICK #foo victim :reason
+		if len(e.Arguments) < 2 {
+			return
+		}
+		r.remove(e.Arguments[0], e.Arguments[1], self)
+	case "QUIT":
+		for _, members := range r.channels {
+			delete(members, r.nicks.fold(e.Nick))
+		}
+	case "NICK":
+		if len(e.Arguments) == 0 {
+			return
+		}
+		old := r.nicks.fold(e.Nick)
+		for _, members := range r.channels {
+			if _, found := members[old]; found {
+				delete(members, old)
+				members[r.nicks.fold(e.Message())] = e.Message()
+			}
+		}
+	}
+}
+
+// Forget about all channels, e.g. after the connection was lost.
+func (r *channelRoster) clear() {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.channels = make(map[string]map[string]string)
+}
+
+// Add a nick to a channel. Expects the mutex to be held.
+func (r *channelRoster) add(channel, nick string) {
+	if len(nick) == 0 {
+		return
+	}
+	key := r.nicks.fold(channel)
+	members, found := r.channels[key]
+	if !found {
+		members = make(map[string]string)
+		r.channels[key] = members
+	}
+	members[r.nicks.fold(nick)] = nick
+}
+
+// Remove a nick from a channel, forget the channel if it is mress
+// leaving. Expects the mutex to be held.
+func (r *channelRoster) remove(channel, nick, self string) {
+	key := r.nicks.fold(channel)
+	if r.nicks.equal(self, nick) {
+		delete(r.channels, key)
+		return
+	}
+	if members, found := r.channels[key]; found {
+		delete(members, r.nicks.fold(nick))
+	}
+}
+
+// Report if nick is in channel.
+func (r *channelRoster) inChannel(channel, nick string) bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	_, found := r.channels[r.nicks.fold(channel)][r.nicks.fold(nick)]
+	return found
+}
+
+// List the channels nick is in (folded).
+func (r *channelRoster) channelsOf(nick string) []string {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	key := r.nicks.fold(nick)
+	channels := []string{}
+	for channel, members := range r.channels {
+		if _, found := members[key]; found {
+			channels = append(channels, channel)
+		}
+	}
+	return channels
+}
+
+// Remove the channel status prefix (op, voice, ...) from a nick
+// as listed in NAMES replies.
+func stripNickPrefix(nick string) string {
+	return strings.TrimLeft(nick, "~&@%+")
+}
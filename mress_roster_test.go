@@ -0,0 +1,83 @@
+package main
+
+import (
+	"github.com/thoj/go-ircevent"
+	"testing"
+)
+
+func Test_channelRoster_0(t *testing.T) {
+	t.Parallel()
+	roster := newChannelRoster(newNickMapper())
+	events := []*irc.Event{
+		{Code: "JOIN", Nick: "mress", Arguments: []string{"#foo"}},
+		{Code: "353", Arguments: []string{"mress", "=", "#foo", "mress tzugh @herr_flupke +Bob"}},
+		{Code: "JOIN", Nick: "alice", Arguments: []string{"#foo"}},
+		{Code: "PART", Nick: "tzugh", Arguments: []string{"#foo", "bye"}},
+		{Code: "NICK", Nick: "herr_flupke", Arguments: []string{"flupke"}},
+		{Code: "KICK", Nick: "flupke", Arguments: []string{"#foo", "alice", "spam"}},
+	}
+	for _, event := range events {
+		roster.handleEvent(event, "mress")
+	}
+	if !roster.inChannel("#FOO", "bob") {
+		t.Error("nick from names list missing")
+	}
+	if !roster.inChannel("#foo", "flupke") {
+		t.Error("nick change missed")
+	}
+	if roster.inChannel("#foo", "herr_flupke") {
+		t.Error("old nick kept")
+	}
+	if roster.inChannel("#foo", "tzugh") {
+		t.Error("part missed")
+	}
+	if roster.inChannel("#foo", "alice") {
+		t.Error("kick missed")
+	}
+	channels := roster.channelsOf("BOB")
+	if 1 != len(channels) || "#foo" != channels[0] {
+		t.Error("present nick not found")
+	}
+
+	roster.handleEvent(&irc.Event{Code: "QUIT", Nick: "bob", Arguments: []string{"gone"}}, "mress")
+	if 0 < len(roster.channelsOf("bob")) {
+		t.Error("quit missed")
+	}
+	roster.handleEvent(&irc.Event{Code: "PART", Nick: "mress", Arguments: []string{"#foo"}}, "mress")
+	if 0 < len(roster.channelsOf("flupke")) {
+		t.Error("channel kept after leaving")
+	}
+}
+
+// nobody is known after a disconnect
+func Test_channelRoster_2(t *testing.T) {
+	t.Parallel()
+	roster := newChannelRoster(newNickMapper())
+	roster.handleEvent(&irc.Event{Code: "353", Arguments: []string{"mress", "=", "#foo", "mress bob"}}, "mress")
+	roster.clear()
+	if roster.inChannel("#foo", "bob") {
+		t.Error("roster not cleared")
+	}
+}
+
+// broken events shouldn't explode
+func Test_channelRoster_1(t *testing.T) {
+	t.Parallel()
+	roster := newChannelRoster(nil)
+	roster.handleEvent(nil, "mress")
+	for _, code := range []string{"353", "JOIN", "PART", "KICK", "QUIT", "NICK", "PRIVMSG"} {
+		roster.handleEvent(&irc.Event{Code: code}, "mress")
+	}
+	if 0 < len(roster.channelsOf("")) {
+		t.Error("empty nick present")
+	}
+}
+
+func Test_stripNickPrefix_0(t *testing.T) {
+	t.Parallel()
+	for _, nick := range []string{"@bob", "+bob", "@+bob", "~bob", "bob"} {
+		if "bob" != stripNickPrefix(nick) {
+			t.Error("prefix not stripped from " + nick)
+		}
+	}
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"fmt"
+	"github.com/thoj/go-ircevent" // imported as "irc"
+	"log"
+	"strings"
+	"sync"
+)
+
+// SASL mechanisms mress can authenticate with.
+const (
+	saslPlain    = "PLAIN"    // account name and password
+	saslExternal = "EXTERNAL" // client TLS certificate (CertFP)
+)
+
+// Settings of SASL authentication (negotiated via IRCv3 CAP).
+type saslConfig struct {
+	mechanism string // empty if SASL is not used
+	login     string // account name
+	password  string
+}
+
+// Report if SASL authentication is configured.
+func (s saslConfig) enabled() bool {
+	return 0 < len(s.mechanism)
+}
+
+// Check if the settings are complete for the mechanism, EXTERNAL
+// needs TLS with a client certificate (see tlsOptions).
+func (s saslConfig) validate(useTLS, clientCert bool) error {
+	switch s.mechanism {
+	case "":
+		return nil
+	case saslPlain:
+		if 0 == len(s.login) || 0 == len(s.password) {
+			return fmt.Errorf("SASL PLAIN needs sasl-login and sasl-password")
+		}
+	case saslExternal:
+		if !useTLS {
+			return fmt.Errorf("SASL EXTERNAL needs a TLS encrypted connection")
+		}
+		if !clientCert {
+			return fmt.Errorf("SASL EXTERNAL needs client-cert and client-key")
+		}
+	default:
+		return fmt.Errorf("unknown SASL mechanism '%s' (use PLAIN or EXTERNAL)", s.mechanism)
+	}
+	return nil
+}
+
+// The part of an IRC connection the SASL exchange needs. Implemented
+// by *irc.Connection, allows replacing the connection in tests.
+type saslConnection interface {
+	AddCallback(eventcode string, callback func(*irc.Event)) int
+	RemoveCallback(eventcode string, i int) bool
+	SendRaw(message string)
+}
+
+// Answers the SASL exchange for mechanisms go-ircevent does not
+// implement (it only sends PLAIN credentials). The library still
+// requests the capability, ends the negotiation and holds back
+// registration until the outcome (903 or an error numeric), but once
+// the server listed its capabilities mress removes the library's
+// callbacks answering CAP ACK and AUTHENTICATE and answers itself.
+// Refusals of the capability are reported for every mechanism.
+type saslExchange struct {
+	mechanism string
+	con       saslConnection
+	reject    func(reason string)
+	logger    *log.Logger
+
+	mutex          sync.Mutex
+	registered     bool // callbacks added, see prepare()
+	capID          int  // of our callback for CAP
+	authenticateID int  // of our callback for AUTHENTICATE
+	tookOver       bool // removed the SASL callbacks of the library
+	started        bool // sent AUTHENTICATE <mechanism>
+}
+
+// Create the SASL exchange for a mechanism, reject is called if the
+// server refuses SASL.
+func newSASLExchange(mechanism string, con saslConnection, reject func(reason string), logger *log.Logger) *saslExchange {
+	return &saslExchange{mechanism: mechanism, con: con, reject: reject, logger: logger}
+}
+
+// Forget the state of the last connection and add our callbacks again.
+// Call right before connecting: go-ircevent adds its SASL callbacks for
+// CAP and AUTHENTICATE first when connecting, so their ids follow ours.
+func (x *saslExchange) prepare() {
+	x.mutex.Lock()
+	defer x.mutex.Unlock()
+	if x.registered {
+		x.con.RemoveCallback("CAP", x.capID)
+		x.con.RemoveCallback("AUTHENTICATE", x.authenticateID)
+	}
+	x.capID = x.con.AddCallback("CAP", x.handleCap)
+	x.authenticateID = x.con.AddCallback("AUTHENTICATE", x.handleAuthenticate)
+	x.registered = true
+	x.tookOver = false
+	x.started = false
+}
+
+// Report if a list of capabilities contains SASL.
+func offersSASL(capabilities string) bool {
+	for _, capability := range strings.Fields(capabilities) {
+		if "sasl" == capability || 0 == strings.Index(capability, "sasl=") {
+			return true
+		}
+	}
+	return false
+}
+
+// Handle the capabilities listed (LS), acknowledged (ACK) and refused
+// (NAK) by the server.
+// To be used as a callback for CAP.
+func (x *saslExchange) handleCap(e *irc.Event) {
+	// * LS|ACK|NAK :<capabilities>
+	if e == nil || 3 > len(e.Arguments) {
+		return
+	}
+	capabilities := e.Message()
+	switch e.Arguments[1] {
+	case "LS":
+		if !offersSASL(capabilities) {
+			x.reject("server does not offer SASL")
+			return
+		}
+		if saslPlain != x.mechanism && !x.takeOver() {
+			x.reject("SASL callbacks of go-ircevent not found, can not answer " + x.mechanism)
+		}
+	case "ACK":
+		if !offersSASL(capabilities) || saslPlain == x.mechanism {
+			return
+		}
+		x.mutex.Lock()
+		start := x.tookOver && !x.started
+		x.started = true
+		x.mutex.Unlock()
+		if start {
+			x.con.SendRaw("AUTHENTICATE " + x.mechanism)
+		}
+	case "NAK":
+		if offersSASL(capabilities) {
+			x.reject("server refused the capability sasl")
+		}
+	}
+}
+
+// Remove the callbacks go-ircevent added for CAP and AUTHENTICATE to
+// answer SASL, the ones negotiating capabilities stay. Reports if both
+// were found.
+func (x *saslExchange) takeOver() bool {
+	x.mutex.Lock()
+	defer x.mutex.Unlock()
+	if x.tookOver {
+		return true
+	}
+	capRemoved := x.con.RemoveCallback("CAP", x.authenticateID+1)
+	authenticateRemoved := x.con.RemoveCallback("AUTHENTICATE", x.authenticateID+2)
+	x.tookOver = capRemoved && authenticateRemoved
+	return x.tookOver
+}
+
+// Answer the server: EXTERNAL takes the identity from the client
+// certificate, so the authorization identity is left empty ("+").
+// To be used as a callback for AUTHENTICATE.
+func (x *saslExchange) handleAuthenticate(e *irc.Event) {
+	if e == nil || "+" != e.Message() {
+		return
+	}
+	x.mutex.Lock()
+	started := x.started
+	x.mutex.Unlock()
+	if started && saslExternal == x.mechanism {
+		x.logger.Println("authenticating via client certificate")
+		x.con.SendRaw("AUTHENTICATE +")
+	}
+}
+
+// Configure the connection to authenticate via SASL and register
+// callbacks reporting the outcome. A rejected authentication stops
+// the network instead of retrying (see run()).
+func (n *ircNetwork) setupSASL() error {
+	s := n.config.sasl
+	err := s.validate(n.config.useTLS, n.config.tls.clientCert())
+	if err != nil {
+		return err
+	}
+	if !s.enabled() {
+		return nil
+	}
+	n.con.UseSASL = true
+	n.con.SASLMech = s.mechanism
+	n.con.SASLLogin = s.login
+	n.con.SASLPassword = s.password
+	if 0 < len(s.login) {
+		n.logger.Println("authenticating via SASL " + s.mechanism + " as " + s.login)
+	} else {
+		n.logger.Println("authenticating via SASL " + s.mechanism)
+	}
+	n.sasl = newSASLExchange(s.mechanism, n.con, n.rejectAuthentication, n.logger)
+
+	n.con.AddCallback("900", func(e *irc.Event) {
+		// <nick> <nick!user@host> <account> :You are now logged in as <account>
+		if 3 <= len(e.Arguments) {
+			n.logger.Println("logged in as " + e.Arguments[2])
+		}
+	})
+	n.con.AddCallback("903", func(e *irc.Event) {
+		n.logger.Println("SASL authentication successful")
+	})
+	for _, code := range []string{"902", "904", "905", "906", "908"} {
+		n.con.AddCallback(code, func(e *irc.Event) {
+			n.rejectAuthentication(e.Code + " " + e.Message())
+		})
+	}
+	return nil
+}
+
+// Remember that the server rejected the authentication.
+func (n *ircNetwork) rejectAuthentication(reason string) {
+	n.logger.Println("SASL authentication rejected: " + reason)
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	n.authError = reason
+}
+
+// Report why the server rejected the authentication, empty if it did not.
+func (n *ircNetwork) authenticationRejected() string {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	return n.authError
+}
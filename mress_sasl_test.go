@@ -0,0 +1,195 @@
+package main
+
+import (
+	"github.com/thoj/go-ircevent" // imported as "irc"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func Test_saslConfig_validate_0(t *testing.T) {
+	t.Parallel()
+	valid := []saslConfig{
+		{},
+		{mechanism: saslPlain, login: "mress", password: "secret"},
+		{mechanism: saslExternal},
+	}
+	for _, sasl := range valid {
+		if err := sasl.validate(true, true); err != nil {
+			t.Error(err.Error())
+		}
+	}
+	broken := []saslConfig{
+		{mechanism: "SCRAM-SHA-256", login: "mress", password: "secret"},
+		{mechanism: saslPlain, login: "mress"},
+		{mechanism: saslPlain, password: "secret"},
+	}
+	for _, sasl := range broken {
+		if err := sasl.validate(true, true); err == nil {
+			t.Error("broken SASL settings for " + sasl.mechanism + " not detected")
+		}
+	}
+	external := saslConfig{mechanism: saslExternal}
+	if err := external.validate(false, true); err == nil {
+		t.Error("EXTERNAL without TLS not detected")
+	}
+	if err := external.validate(true, false); err == nil {
+		t.Error("EXTERNAL without client certificate not detected")
+	}
+}
+
+func Test_ircNetwork_setupSASL_0(t *testing.T) {
+	t.Parallel()
+	config := networkConfig{name: "oftc", server: "irc.oftc.net", port: 6697, useTLS: true, nick: "mress"}
+	config.sasl = saslConfig{mechanism: saslPlain, login: "account", password: "secret"}
+	network, err := newNetwork(config, openTestDatabase(t), nil, offlineSettings{}, false, createLogger(""))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer network.store.close()
+	con := network.con
+	if !con.UseSASL || saslPlain != con.SASLMech || "account" != con.SASLLogin || "secret" != con.SASLPassword {
+		t.Error("SASL not configured")
+	}
+	if 0 < len(network.authenticationRejected()) {
+		t.Error("rejected before connecting")
+	}
+	con.RunCallbacks(&irc.Event{Code: "904", Arguments: []string{"mress", "SASL authentication failed"}})
+	if "904 SASL authentication failed" != network.authenticationRejected() {
+		t.Error("rejection missed: " + network.authenticationRejected())
+	}
+}
+
+// broken settings and missing certificates are reported before connecting
+func Test_ircNetwork_setupSASL_1(t *testing.T) {
+	t.Parallel()
+	db := openTestDatabase(t)
+	config := networkConfig{name: "oftc", server: "irc.oftc.net", port: 6697, useTLS: true, nick: "mress"}
+	config.sasl = saslConfig{mechanism: saslPlain, login: "account"}
+	if _, err := newNetwork(config, db, nil, offlineSettings{}, false, createLogger("")); err == nil {
+		t.Error("missing password not detected")
+	}
+	config.sasl = saslConfig{mechanism: saslExternal}
+	if _, err := newNetwork(config, db, nil, offlineSettings{}, false, createLogger("")); err == nil {
+		t.Error("missing client certificate not detected")
+	}
+}
+
+// A server authenticating a client via SASL, mechanism and response are
+// the lines expected from the client. Closes the connection once the
+// client registered.
+func saslSession(mechanism, response string) func(c *testClient) {
+	return func(c *testClient) {
+		c.expectNext("CAP LS")
+		c.send(":irc.local CAP * LS :multi-prefix sasl")
+		c.expectNext("CAP REQ :sasl")
+		c.send(":irc.local CAP * ACK :sasl")
+		c.expectNext("AUTHENTICATE " + mechanism)
+		c.send("AUTHENTICATE +")
+		c.expectNext("AUTHENTICATE " + response)
+		c.send(":irc.local 900 mress mress!mress@localhost mress :You are now logged in as mress")
+		c.send(":irc.local 903 mress :SASL authentication successful")
+		c.expectNext("CAP END")
+		c.expectNext("NICK mress")
+		c.expectNext("USER ")
+	}
+}
+
+// Connect go-ircevent to a local server, with the SASL exchange of mress.
+func connectSASL(t *testing.T, mechanism string, sessions ...func(c *testClient)) (*irc.Connection, *saslExchange, *string) {
+	port := startTestServer(t, make(chan int, 10), sessions...)
+	con := irc.IRC("mress", "mress")
+	con.Log = createLogger("")
+	con.UseSASL = true
+	con.SASLMech = mechanism
+	con.SASLLogin = "mress"
+	con.SASLPassword = "s3cr3t"
+	rejected := new(string)
+	x := newSASLExchange(mechanism, con, func(reason string) { *rejected = reason }, createLogger(""))
+	x.prepare()
+	if err := con.Connect("127.0.0.1:" + strconv.Itoa(port)); err != nil {
+		t.Fatal(err.Error())
+	}
+	return con, x, rejected
+}
+
+// EXTERNAL is answered by mress, go-ircevent still negotiates the
+// capabilities, also after reconnecting
+func Test_saslExchange_0(t *testing.T) {
+	t.Parallel()
+	session := saslSession(saslExternal, "+")
+	con, x, rejected := connectSASL(t, saslExternal, session, session)
+	<-con.ErrorChan()
+	con.Disconnect()
+	x.prepare()
+	if err := con.Reconnect(); err != nil {
+		t.Fatal("reconnecting failed: " + err.Error())
+	}
+	<-con.ErrorChan()
+	con.Disconnect()
+	if 0 < len(*rejected) {
+		t.Error("rejected: " + *rejected)
+	}
+}
+
+// PLAIN is left to go-ircevent
+func Test_saslExchange_1(t *testing.T) {
+	t.Parallel()
+	con, _, rejected := connectSASL(t, saslPlain, saslSession(saslPlain, "bXJlc3MAbXJlc3MAczNjcjN0"))
+	<-con.ErrorChan()
+	con.Disconnect()
+	if 0 < len(*rejected) {
+		t.Error("rejected: " + *rejected)
+	}
+}
+
+// refusals are reported for every mechanism
+func Test_saslExchange_2(t *testing.T) {
+	t.Parallel()
+	for _, mechanism := range []string{saslPlain, saslExternal} {
+		con := irc.IRC("mress", "mress")
+		rejected := ""
+		x := newSASLExchange(mechanism, con, func(reason string) { rejected = reason }, createLogger(""))
+		x.prepare()
+		con.RunCallbacks(&irc.Event{Code: "CAP", Arguments: []string{"*", "LS", "multi-prefix away-notify"}})
+		if "server does not offer SASL" != rejected {
+			t.Error("missing SASL not reported for " + mechanism)
+		}
+		rejected = ""
+		con.RunCallbacks(&irc.Event{Code: "CAP", Arguments: []string{"*", "NAK", "sasl"}})
+		if "server refused the capability sasl" != rejected {
+			t.Error("NAK not reported for " + mechanism)
+		}
+	}
+	// without the callbacks of the library mress can not take over
+	con := irc.IRC("mress", "mress")
+	rejected := ""
+	x := newSASLExchange(saslExternal, con, func(reason string) { rejected = reason }, createLogger(""))
+	x.prepare()
+	con.RunCallbacks(&irc.Event{Code: "CAP", Arguments: []string{"*", "LS", "sasl"}})
+	if !strings.Contains(rejected, "callbacks of go-ircevent not found") {
+		t.Error("missing callbacks of the library not reported: " + rejected)
+	}
+}
+
+// a server without SASL stops the network instead of registering unauthenticated
+func Test_ircNetwork_setupSASL_2(t *testing.T) {
+	t.Parallel()
+	_, certFile, keyFile := createTestCertificate(t)
+	config := networkConfig{name: "oftc", server: "irc.oftc.net", port: 6697, useTLS: true, nick: "mress"}
+	config.tls = tlsOptions{certFile: certFile, keyFile: keyFile}
+	config.sasl = saslConfig{mechanism: saslExternal}
+	network, err := newNetwork(config, openTestDatabase(t), nil, offlineSettings{}, false, createLogger(""))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer network.store.close()
+	if !network.con.UseSASL || saslExternal != network.con.SASLMech {
+		t.Error("SASL not configured")
+	}
+	network.sasl.prepare()
+	network.con.RunCallbacks(&irc.Event{Code: "CAP", Arguments: []string{"*", "LS", "multi-prefix"}})
+	if "server does not offer SASL" != network.authenticationRejected() {
+		t.Error("missing SASL not reported: " + network.authenticationRejected())
+	}
+}
@@ -2,10 +2,12 @@ package main
 
 import (
 	//"github.com/thoj/go-ircevent"
-	"log"
+	"io/ioutil"
 	"os"
-	"strconv"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 )
 
 // test stdout destination
@@ -64,471 +66,299 @@ func Test_create_Logger_4(t *testing.T) {
 	}
 }
 
-func Test_readConfigInt_0(t *testing.T) {
-	config := "test.ini"
-	section := "IRC"
-	key := "port"
-	logger := createLogger("")
-	if logger == nil {
-		t.Log("creating test logger failed")
-	}
-	port, err := readConfigInt(config, section, key, logger)
-	if err != nil {
-		t.Fatal(err.Error())
+// load config, failing on errors
+func loadTestConfig(t *testing.T, file string, flags map[string]string) *Config {
+	config, errors := loadConfig(file, flags)
+	for _, err := range errors {
+		t.Error(err.Error())
 	}
-	if port != 6697 {
-		t.Error("wrong integer read")
+	if config == nil {
+		t.Fatal("no config loaded")
 	}
+	return config
 }
 
-func Test_readConfigInt_1(t *testing.T) {
-	config := ""
-	section := "IRC"
-	key := "port"
-	logger := createLogger("")
-	if logger == nil {
-		t.Log("creating test logger failed")
+func Test_loadConfig_0(t *testing.T) {
+	config := loadTestConfig(t, "test.ini", nil)
+	if "mress.log" != config.logDestination {
+		t.Error("read wrong log destination (" + config.logDestination + ") from config")
 	}
-	_, err := readConfigInt(config, section, key, logger)
-	if err == nil {
-		t.Error("failed to detect empty configuration file path")
+	if "messages.db" != config.dbfile {
+		t.Error("read wrong filename (" + config.dbfile + ") from config")
 	}
-}
-
-func Test_readConfigInt_2(t *testing.T) {
-	config := "test.ini"
-	section := ""
-	key := "port"
-	logger := createLogger("")
-	if logger == nil {
-		t.Log("creating test logger failed")
+	if !config.keys.enabled() || "k2" != config.keys.current {
+		t.Error("did not read keys from config")
 	}
-	_, err := readConfigInt(config, section, key, logger)
-	if err == nil {
-		t.Fatal("failed to detect empty section string")
+	offline := config.offline
+	if 3 != offline.pushLimit || 30*24*time.Hour != offline.maxAge || !offline.notifyExpired || scopeChannel != offline.scope {
+		t.Error("read wrong offline messaging settings from config")
 	}
-}
-
-func Test_readConfigInt_3(t *testing.T) {
-	config := "test.ini"
-	section := "IRC"
-	key := ""
-	logger := createLogger("")
-	if logger == nil {
-		t.Log("creating test logger failed")
-	}
-	_, err := readConfigInt(config, section, key, logger)
-	if err == nil {
-		t.Error("failed to detect empty key string")
+	if 10 != offline.quota.perSender || 0 != offline.quota.perRecipient || 1000 != offline.quota.total || 300 != offline.quota.maxLength {
+		t.Error("read wrong quota from config")
 	}
 }
 
-func Test_readConfigInt_4(t *testing.T) {
-	config := "empty_test.ini"
-	section := "IRC"
-	key := "port"
-	logger := createLogger("")
-	if logger == nil {
-		t.Log("creating test logger failed")
+// networks listed in the section "IRC"
+func Test_loadConfig_1(t *testing.T) {
+	config := loadTestConfig(t, "test.ini", map[string]string{"server": "irc.example.org"})
+	networks := config.networks
+	if 2 != len(networks) || "freenode" != networks[0].name || "oftc" != networks[1].name {
+		t.Fatal("read wrong networks from config")
 	}
-	_, err := readConfigInt(config, section, key, logger)
-	if err == nil {
-		t.Error("failed to detect missing entries in config")
+	if "freenode" != config.legacyNetwork {
+		t.Error("read wrong legacy-network from config")
 	}
-}
-
-func Test_readConfigString_0(t *testing.T) {
-	config := "test.ini"
-	section := "IRC"
-	key := "server"
-	logger := createLogger("")
-	if logger == nil {
-		t.Log("creating test logger failed")
+	freenode := networks[0]
+	if "chat.freenode.net" != freenode.server || 6697 != freenode.port || !freenode.useTLS || "mress" != freenode.nick || 5 != freenode.maxRetries {
+		t.Error("read wrong settings of freenode")
 	}
-	server, err := readConfigString(config, section, key, logger)
-	if err != nil {
-		t.Fatal(err.Error())
+	if 1 != len(freenode.channels) || "#foo" != freenode.channels[0].name || !freenode.channels[0].publicDelivery {
+		t.Error("read wrong channels of freenode")
 	}
-	if server != "chat.freenode.net" {
-		t.Error("wrong server read")
+	if "freenode-secret" != freenode.channels[0].key {
+		t.Error("section of the channel in the network not chosen over the shared one")
 	}
-}
-
-func Test_readConfigString_1(t *testing.T) {
-	config := ""
-	section := "IRC"
-	key := "server"
-	logger := createLogger("")
-	if logger == nil {
-		t.Log("creating test logger failed")
+	if saslExternal != freenode.sasl.mechanism || "mress.crt" != freenode.tls.certFile || "mress.key" != freenode.tls.keyFile {
+		t.Error("read wrong SASL settings of freenode")
 	}
-	_, err := readConfigString(config, section, key, logger)
-	if err == nil {
-		t.Error("failed to detect empty configuration file path")
+	oftc := networks[1]
+	if "irc.oftc.net" != oftc.server || 6667 != oftc.port || oftc.useTLS || "mress2" != oftc.nick || 0 != oftc.maxRetries || 0 != len(oftc.channels) {
+		t.Error("read wrong settings of oftc")
 	}
-}
-
-func Test_readConfigString_2(t *testing.T) {
-	config := "test.ini"
-	section := ""
-	key := "server"
-	logger := createLogger("")
-	if logger == nil {
-		t.Log("creating test logger failed")
+	if oftc.sasl.enabled() || oftc.tls.configured() {
+		t.Error("settings of the section IRC used for oftc")
 	}
-	_, err := readConfigString(config, section, key, logger)
-	if err == nil {
-		t.Fatal("failed to detect empty section string")
+	if 0 < len(oftc.nickserv.password) || recoverRegain != oftc.nickserv.recover {
+		t.Error("read wrong NickServ settings of oftc")
 	}
 }
 
-func Test_readConfigString_3(t *testing.T) {
-	config := "test.ini"
-	section := "IRC"
-	key := ""
-	logger := createLogger("")
-	if logger == nil {
-		t.Log("creating test logger failed")
+// the network configured in the section "IRC"
+func Test_loadConfig_2(t *testing.T) {
+	l := newConfigLoader("test.ini", nil)
+	network := l.network(defaultNetwork, "IRC", networkConfig{port: 6697, useTLS: true, nick: "mress"}, true)
+	if "chat.freenode.net" != network.server || 6697 != network.port || "mress" != network.nick || "1234foobar" != network.password || 5 != network.maxRetries {
+		t.Error("read wrong settings from config")
 	}
-	_, err := readConfigString(config, section, key, logger)
-	if err == nil {
-		t.Error("failed to detect empty key string")
+	if 2 != len(network.channels) || "#foo" != network.channels[0].name || "#bar" != network.channels[1].name {
+		t.Fatal("read wrong channels from config")
 	}
-}
-
-func Test_readConfigString_4(t *testing.T) {
-	config := "empty_test.ini"
-	section := "IRC"
-	key := "server"
-	logger := createLogger("")
-	if logger == nil {
-		t.Log("creating test logger failed")
+	if !network.channels[0].offlineMessages || !network.channels[0].publicDelivery || "secret" != network.channels[0].key {
+		t.Error("read wrong settings of #foo")
 	}
-	_, err := readConfigString(config, section, key, logger)
-	if err == nil {
-		t.Error("failed to detect missing entries in config")
+	if network.channels[1].offlineMessages || network.channels[1].publicDelivery || "" != network.channels[1].key {
+		t.Error("read wrong settings of #bar")
 	}
-}
-
-func Test_getLogger_0(t *testing.T) {
-	dest := ""
-	conf := "test.ini"
-	logchan := make(chan *log.Logger)
-	go getLogger(dest, conf, logchan)
-	//getLogger(destination, configfile string, logger chan *log.Logger)
-	logger := <-logchan
-	if logger == nil {
-		t.Error("creating logger failed")
+	if saslPlain != network.sasl.mechanism || "mress" != network.sasl.login || "s3cr3t" != network.sasl.password {
+		t.Error("read wrong SASL settings")
 	}
-}
-
-func Test_getLogger_1(t *testing.T) {
-	dest := ""
-	conf := "test.ini"
-	logchan := make(chan *log.Logger)
-	go getLogger(dest, conf, logchan)
-	logger := <-logchan
-	if logger == nil {
-		t.Error("handling empty destination string failed")
+	if "n1ckserv" != network.nickserv.password || recoverGhost != network.nickserv.recover {
+		t.Error("read wrong NickServ settings")
 	}
-}
-
-func Test_getLogger_2(t *testing.T) {
-	dest := ""
-	conf := ""
-	logchan := make(chan *log.Logger)
-	go getLogger(dest, conf, logchan)
-	logger := <-logchan
-	if logger == nil {
-		t.Error("handling empty file path failed")
+	options := network.tls
+	if "ca.pem" != options.caFile || "1.3" != options.minVersion || options.clientCert() {
+		t.Error("read wrong TLS settings")
 	}
-}
-
-func Test_getChannel_0(t *testing.T) {
-	testflag := "#bar"
-	config := "test.ini"
-	testchan := make(chan string)
-	logger := createLogger("")
-	go getChannel(testflag, config, testchan, logger)
-	cstring := <-testchan
-	if cstring != "#bar" {
-		t.Error("read wrong channel")
+	if 2 != len(options.fingerprints) || !strings.HasPrefix(options.fingerprints[0], "6e340b9c") || !strings.HasPrefix(options.fingerprints[1], "2cf24dba") {
+		t.Error("read wrong fingerprints")
 	}
 }
 
-func Test_getChannel_1(t *testing.T) {
-	testflag := ""
-	config := "test.ini"
-	testchan := make(chan string)
-	logger := createLogger("")
-	go getChannel(testflag, config, testchan, logger)
-	cstring := <-testchan
-	if cstring != "#foo" {
-		t.Error("read wrong channel")
+// flags override the config file
+func Test_loadConfig_3(t *testing.T) {
+	flags := map[string]string{
+		"log":                "stderr",
+		"nick":               "testbot",
+		"passwd":             "424242",
+		"server":             "example.org",
+		"port":               "23",
+		"channel":            "#baz, #qux",
+		"max-retries":        "3",
+		"use-tls":            "false",
+		"offline-msg-db":     "foobar.db",
+		"offline-push-limit": "7",
+		"offline-max-age":    "12h",
 	}
-}
-
-func Test_getChannel_2(t *testing.T) {
-	testflag := "#bar"
-	config := "test.ini"
-	testchan := make(chan string)
-	logger := createLogger("")
-	go getChannel(testflag, config, testchan, logger)
-	cstring := <-testchan
-	if cstring != "#bar" {
+	config := loadTestConfig(t, "empty_test.ini", flags)
+	if "stderr" != config.logDestination || "foobar.db" != config.dbfile {
 		t.Error("did not select flag over config value")
 	}
-}
-
-func Test_getChannel_3(t *testing.T) {
-	testflag := ""
-	config := "empty_test.ini"
-	testchan := make(chan string)
-	logger := createLogger("")
-	go getChannel(testflag, config, testchan, logger)
-	cstring := <-testchan
-	if cstring != "" {
-		t.Error("did not handle empty/missing channel strings")
+	if 7 != config.offline.pushLimit || 12*time.Hour != config.offline.maxAge {
+		t.Error("did not select flag over config value for offline messaging")
 	}
-}
-
-func Test_getNick_0(t *testing.T) {
-	testflag := "testbot"
-	config := "test.ini"
-	testchan := make(chan string)
-	logger := createLogger("")
-	go getNick(testflag, config, testchan, logger)
-	cstring := <-testchan
-	if cstring != testflag {
-		t.Error("read wrong nick")
+	if 1 != len(config.networks) || defaultNetwork != config.networks[0].name {
+		t.Fatal("did not use network of the section IRC")
 	}
-}
-
-func Test_getNick_1(t *testing.T) {
-	testflag := ""
-	config := "test.ini"
-	testchan := make(chan string)
-	logger := createLogger("")
-	go getNick(testflag, config, testchan, logger)
-	cstring := <-testchan
-	if cstring != "mress" {
-		t.Error("read wrong nick (" + cstring + ") from config")
+	network := config.networks[0]
+	if "testbot" != network.nick || "424242" != network.password || "example.org" != network.server || 23 != network.port || 3 != network.maxRetries || network.useTLS {
+		t.Error("did not select flag over config value for the network")
 	}
-}
-
-func Test_getNick_2(t *testing.T) {
-	testflag := "testbot"
-	config := "test.ini"
-	testchan := make(chan string)
-	logger := createLogger("")
-	go getNick(testflag, config, testchan, logger)
-	cstring := <-testchan
-	if cstring != "testbot" {
-		t.Error("did not select flag over config value")
+	if 2 != len(network.channels) || "#baz" != network.channels[0].name || "#qux" != network.channels[1].name {
+		t.Fatal("did not select flag over config value for channels")
 	}
-}
-
-func Test_getNick_3(t *testing.T) {
-	testflag := ""
-	config := "empty_test.ini"
-	testchan := make(chan string)
-	logger := createLogger("")
-	go getNick(testflag, config, testchan, logger)
-	cstring := <-testchan
-	if cstring != "" {
-		t.Error("did not handle empty/missing nick strings")
+	if !network.channels[1].offlineMessages {
+		t.Error("offline messages not enabled by default")
 	}
-}
 
-func Test_getPassword_0(t *testing.T) {
-	testflag := "424242"
-	config := "test.ini"
-	testchan := make(chan string)
-	logger := createLogger("")
-	go getPassword(testflag, config, testchan, logger)
-	cstring := <-testchan
-	if cstring != testflag {
-		t.Error("read wrong password")
+	// only nick and max-retries apply to listed networks
+	delete(flags, "use-tls")
+	config = loadTestConfig(t, "test.ini", flags)
+	freenode := config.networks[0]
+	if "chat.freenode.net" != freenode.server || "testbot" != freenode.nick || 3 != freenode.maxRetries || 1 != len(freenode.channels) {
+		t.Error("wrong flags applied to listed network")
 	}
-}
 
-func Test_getPassword_1(t *testing.T) {
-	testflag := ""
-	config := "test.ini"
-	testchan := make(chan string)
-	logger := createLogger("")
-	go getPassword(testflag, config, testchan, logger)
-	cstring := <-testchan
-	if cstring != "1234foobar" {
-		t.Error("read wrong password (" + cstring + ") from config")
+	// EXTERNAL of freenode needs TLS
+	flags["use-tls"] = "false"
+	if _, errors := loadConfig("test.ini", flags); 1 != len(errors) {
+		t.Error("SASL EXTERNAL without TLS not reported")
 	}
 }
 
-func Test_getPassword_2(t *testing.T) {
-	testflag := "424242"
-	config := "test.ini"
-	testchan := make(chan string)
-	logger := createLogger("")
-	go getNick(testflag, config, testchan, logger)
-	cstring := <-testchan
-	if cstring != "424242" {
-		t.Error("did not select flag over config value")
+// defaults
+func Test_loadConfig_4(t *testing.T) {
+	config, errors := loadConfig("empty_test.ini", nil)
+	if 1 != len(errors) || !strings.Contains(errors[0].Error(), "server") {
+		t.Error("missing server not reported")
 	}
-}
-
-func Test_getPassword_3(t *testing.T) {
-	testflag := ""
-	config := "empty_test.ini"
-	testchan := make(chan string)
-	logger := createLogger("")
-	go getNick(testflag, config, testchan, logger)
-	cstring := <-testchan
-	if cstring != "" {
-		t.Error("did not handle empty/missing nick strings")
+	if "" != config.logDestination || "messages.db" != config.dbfile || config.keys.enabled() {
+		t.Error("wrong defaults")
 	}
-}
-
-func Test_getServer_0(t *testing.T) {
-	testflag := "example.org"
-	config := "test.ini"
-	testchan := make(chan string)
-	logger := createLogger("")
-	go getServer(testflag, config, testchan, logger)
-	cstring := <-testchan
-	if cstring != testflag {
-		t.Error("read wrong server")
+	offline := config.offline
+	if defaultPushLimit != offline.pushLimit || 0 != offline.maxAge || offline.notifyExpired || defaultOfflineQuota != offline.quota || scopeNetwork != offline.scope {
+		t.Error("wrong defaults for offline messaging")
 	}
-}
-
-func Test_getServer_1(t *testing.T) {
-	testflag := ""
-	config := "test.ini"
-	testchan := make(chan string)
-	logger := createLogger("")
-	go getServer(testflag, config, testchan, logger)
-	cstring := <-testchan
-	if cstring != "chat.freenode.net" {
-		t.Error("read wrong server (" + cstring + ") from config")
+	network := config.networks[0]
+	if "mress" != network.nick || 6697 != network.port || !network.useTLS || 0 != network.maxRetries || 0 != len(network.channels) {
+		t.Error("wrong defaults for the network")
 	}
-}
-
-func Test_getServer_2(t *testing.T) {
-	testflag := "example.org"
-	config := "test.ini"
-	testchan := make(chan string)
-	logger := createLogger("")
-	go getServer(testflag, config, testchan, logger)
-	cstring := <-testchan
-	if cstring != "example.org" {
-		t.Error("did not select flag over config value")
+	if network.sasl.enabled() || network.tls.configured() || 0 < len(network.nickserv.password) || recoverRegain != network.nickserv.recover {
+		t.Error("wrong defaults for authentication")
 	}
-}
 
-func Test_getServer_3(t *testing.T) {
-	testflag := ""
-	config := "empty_test.ini"
-	testchan := make(chan string)
-	logger := createLogger("")
-	go getServer(testflag, config, testchan, logger)
-	cstring := <-testchan
-	if cstring != "" {
-		t.Error("did not handle empty/missing server strings")
+	// no config file at all
+	if _, errors = loadConfig("missing.ini", map[string]string{"server": "irc.example.org"}); 0 < len(errors) {
+		t.Error(errors[0].Error())
 	}
-}
-
-func Test_getPort_0(t *testing.T) {
-	testflag := 23
-	config := "test.ini"
-	testchan := make(chan int)
-	logger := createLogger("")
-	go getPort(testflag, config, testchan, logger)
-	cint := <-testchan
-	if cint != testflag {
-		t.Error("read wrong port")
+	if _, errors = loadConfig("missing.ini", map[string]string{"config": "missing.ini", "server": "irc.example.org"}); 0 == len(errors) {
+		t.Error("missing config file not reported")
 	}
 }
 
-func Test_getPort_1(t *testing.T) {
-	testflag := 0
-	config := "test.ini"
-	testchan := make(chan int)
-	logger := createLogger("")
-	go getPort(testflag, config, testchan, logger)
-	cint := <-testchan
-	if cint != 6697 {
-		t.Error("read wrong port (" + strconv.Itoa(cint) + ") from config")
+// all broken settings are reported at once
+func Test_loadConfig_5(t *testing.T) {
+	_, errors := loadConfig("broken_test.ini", map[string]string{"offline-keyfile": "missing-keyfile"})
+	expected := []string{
+		"[IRC] port", "[IRC] nickname", "'foo' is no channel", "channel #bar listed twice",
+		"[IRC] max-retries", "[IRC] nickserv-recover", "[IRC] TLS",
+		"network libera listed twice", "[network missing]", "[IRC] legacy-network",
+		"[network libera] port", "[network libera] use-tls", "[network libera] server",
+		"[network libera] sasl-mechanism",
+		"[offline messaging] dbfile", "[offline messaging] push-limit", "[offline messaging] max-age",
+		"[offline messaging] notify-expired", "[offline messaging] max-pending", "[offline messaging] scope",
+		"flag -offline-keyfile",
+	}
+	reported := ""
+	for _, err := range errors {
+		reported += err.Error() + "\n"
+	}
+	for _, what := range expected {
+		if !strings.Contains(reported, what) {
+			t.Error("not reported: " + what)
+		}
+	}
+	if t.Failed() {
+		t.Log(reported)
 	}
 }
 
-func Test_getPort_2(t *testing.T) {
-	testflag := 23
-	config := "test.ini"
-	testchan := make(chan int)
-	logger := createLogger("")
-	go getPort(testflag, config, testchan, logger)
-	cint := <-testchan
-	if cint != 23 {
+func Test_configLoader_lookup_0(t *testing.T) {
+	l := newConfigLoader("test.ini", map[string]string{"server": "example.org"})
+	if value, found := l.lookup("", "IRC", "server"); !found || "chat.freenode.net" != value {
+		t.Error("wrong server read")
+	}
+	if value, found := l.lookup("server", "IRC", "server"); !found || "example.org" != value {
 		t.Error("did not select flag over config value")
 	}
-}
-
-func Test_getPort_3(t *testing.T) {
-	testflag := 0
-	config := "empty_test.ini"
-	testchan := make(chan int)
-	logger := createLogger("")
-	go getPort(testflag, config, testchan, logger)
-	cint := <-testchan
-	if cint != 0 {
-		t.Error("did not handle missing port numbers")
+	if _, found := l.lookup("", "", "server"); found {
+		t.Error("failed to detect empty section string")
 	}
-}
-
-// test determining database filename
-func Test_getOfflineDBfilename_0(t *testing.T) {
-	testflag := "foobar.db"
-	config := "test.ini"
-	testchan := make(chan string)
-	logger := createLogger("")
-	go getOfflineDBfilename(testflag, config, testchan, logger)
-	cstring := <-testchan
-	if cstring != testflag {
-		t.Error("read wrong database filename")
+	if _, found := l.lookup("", "IRC", ""); found {
+		t.Error("failed to detect empty key string")
+	}
+	if 6697 != l.getInt("", "IRC", "port", 0, 1) {
+		t.Error("wrong integer read")
+	}
+	l = newConfigLoader("empty_test.ini", nil)
+	if _, found := l.lookup("", "IRC", "server"); found {
+		t.Error("failed to detect missing entries in config")
+	}
+	l = newConfigLoader("", nil)
+	if _, found := l.lookup("", "IRC", "server"); found || 0 < len(l.errors) {
+		t.Error("failed to handle empty configuration file path")
 	}
 }
 
-func Test_getOfflineDBfilename_1(t *testing.T) {
-	testflag := ""
-	config := "test.ini"
-	testchan := make(chan string)
-	logger := createLogger("")
-	go getOfflineDBfilename(testflag, config, testchan, logger)
-	cstring := <-testchan
-	if cstring != "messages.db" {
-		t.Error("read wrong filename (" + cstring + ") from config")
+// environment variables override the config file, flags override both
+func Test_loadConfig_6(t *testing.T) {
+	env := map[string]string{
+		"MRESS_SERVER":            "irc.example.org",
+		"MRESS_PORT":              "6667",
+		"MRESS_NICKNAME":          "envbot",
+		"MRESS_PASSWORD":          "env-s3cr3t",
+		"MRESS_CHANNEL":           "#env, #vars",
+		"MRESS_DBFILE":            "env.db",
+		"MRESS_LOG_DESTINATION":   "stdout",
+		"MRESS_SASL_PASSWORD":     "env-sasl",
+		"MRESS_NICKSERV_PASSWORD": "env-nickserv",
+		"MRESS_ENCRYPTION_KEYS":   "k3:kiY4h7sHHmiSUwYbIbIpU3uF5klk5gwnG0Jz+EkOoQs=",
+	}
+	for name, value := range env {
+		t.Setenv(name, value)
+	}
+	config := loadTestConfig(t, "empty_test.ini", nil)
+	network := config.networks[0]
+	if "irc.example.org" != network.server || 6667 != network.port || "envbot" != network.nick || "env-s3cr3t" != network.password {
+		t.Error("did not read network from environment")
+	}
+	if 2 != len(network.channels) || "#env" != network.channels[0].name || "#vars" != network.channels[1].name {
+		t.Error("did not read channels from environment")
+	}
+	if "env.db" != config.dbfile || "stdout" != config.logDestination {
+		t.Error("did not read files from environment")
+	}
+	if "env-sasl" != network.sasl.password || "env-nickserv" != network.nickserv.password {
+		t.Error("did not read services passwords from environment")
+	}
+	if 1 != len(config.keys.ids()) || "k3" != currentKey(config.keys) {
+		t.Error("did not read encryption keys from environment")
 	}
-}
 
-func Test_getOfflineDBfilename_2(t *testing.T) {
-	testflag := "foobar.db"
-	config := "test.ini"
-	testchan := make(chan string)
-	logger := createLogger("")
-	go getOfflineDBfilename(testflag, config, testchan, logger)
-	cstring := <-testchan
-	if cstring != "foobar.db" {
-		t.Error("did not select flag over config value")
+	keyfile := filepath.Join(t.TempDir(), "keys")
+	err := ioutil.WriteFile(keyfile, []byte("k4:fjaX8LWAU/2h+BvRH0j3eJMtLs8ZG2lwGzGOfzDJ72I=\n"), 0600)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	t.Setenv("MRESS_ENCRYPTION_KEYFILE", keyfile)
+	config = loadTestConfig(t, "test.ini", map[string]string{"server": "flag.example.org", "offline-msg-db": "flag.db"})
+	if "flag.db" != config.dbfile || "stdout" != config.logDestination {
+		t.Error("wrong precedence of flags, environment and config file")
+	}
+	if 1 != len(config.keys.ids()) || "k4" != currentKey(config.keys) {
+		t.Error("key file from environment not chosen over the config file")
+	}
+	if "envbot" != config.networks[0].nick || "chat.freenode.net" != config.networks[0].server {
+		t.Error("wrong settings from environment applied to listed network")
+	}
+	l := newConfigLoader("test.ini", map[string]string{"server": "flag.example.org"})
+	fallback := l.network(defaultNetwork, "IRC", networkConfig{port: 6697, useTLS: true, nick: "mress"}, true)
+	if "flag.example.org" != fallback.server || 6667 != fallback.port || "env-s3cr3t" != fallback.password {
+		t.Error("wrong precedence for the network of the section IRC")
 	}
-}
 
-func Test_getOfflineDBfilename_3(t *testing.T) {
-	testflag := ""
-	config := "empty_test.ini"
-	testchan := make(chan string)
-	logger := createLogger("")
-	go getOfflineDBfilename(testflag, config, testchan, logger)
-	cstring := <-testchan
-	if cstring != "" {
-		t.Error("did not handle empty/missing database filename")
+	t.Setenv("MRESS_PORT", "ircs")
+	_, errors := loadConfig("empty_test.ini", nil)
+	if 1 != len(errors) || !strings.Contains(errors[0].Error(), "environment variable MRESS_PORT") {
+		t.Error("invalid environment variable not reported")
 	}
 }
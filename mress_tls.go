@@ -0,0 +1,160 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"strings"
+)
+
+// Minimum TLS version used unless configured otherwise.
+const defaultTLSMinVersion = tls.VersionTLS12
+
+// TLS versions by the name used in the config.
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// Settings of TLS encrypted connections.
+type tlsOptions struct {
+	certFile     string   // client certificate (PEM), e.g. for CertFP
+	keyFile      string   // key of the client certificate (PEM)
+	caFile       string   // CA bundle (PEM) instead of the system's
+	minVersion   string   // "1.0" to "1.3", empty for defaultTLSMinVersion
+	fingerprints []string // pinned SHA-256 fingerprints of the server certificate
+}
+
+// Report if a client certificate is configured.
+func (o tlsOptions) clientCert() bool {
+	return 0 < len(o.certFile) || 0 < len(o.keyFile)
+}
+
+// Report if anything differs from the defaults.
+func (o tlsOptions) configured() bool {
+	return o.clientCert() || 0 < len(o.caFile) || 0 < len(o.minVersion) || 0 < len(o.fingerprints)
+}
+
+// Check if the minimum version is known and the fingerprints are
+// SHA-256 fingerprints (normalized, see normalizeFingerprint()).
+func (o tlsOptions) validate() error {
+	if _, found := tlsVersions[o.minVersion]; 0 < len(o.minVersion) && !found {
+		return fmt.Errorf("unknown tls-min-version '%s' (use 1.0, 1.1, 1.2 or 1.3)", o.minVersion)
+	}
+	for _, pin := range o.fingerprints {
+		if _, err := hex.DecodeString(pin); err != nil || sha256.Size*2 != len(pin) {
+			return fmt.Errorf("tls-fingerprint '%s' is no SHA-256 fingerprint", pin)
+		}
+	}
+	if 0 < len(o.certFile) && 0 == len(o.keyFile) {
+		return fmt.Errorf("client-cert without client-key")
+	}
+	if 0 == len(o.certFile) && 0 < len(o.keyFile) {
+		return fmt.Errorf("client-key without client-cert")
+	}
+	return nil
+}
+
+// Build the TLS config: client certificate, CA bundle, minimum version
+// and a check of the server certificate logging the negotiated cipher
+// and fingerprint. Pinned fingerprints replace the verification against
+// CAs, so self-signed certificates can be pinned.
+func (o tlsOptions) tlsConfig(logger *log.Logger) (*tls.Config, error) {
+	err := o.validate()
+	if err != nil {
+		return nil, err
+	}
+	config := &tls.Config{MinVersion: defaultTLSMinVersion}
+	if 0 < len(o.minVersion) {
+		config.MinVersion = tlsVersions[o.minVersion]
+	}
+	if o.clientCert() {
+		cert, err := tls.LoadX509KeyPair(o.certFile, o.keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("loading client certificate failed: %v", err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+		if 0 < len(cert.Certificate) {
+			logger.Println("using client certificate " + certFingerprint(cert.Certificate[0]))
+		}
+	}
+	if 0 < len(o.caFile) {
+		pem, err := ioutil.ReadFile(o.caFile)
+		if err != nil {
+			return nil, fmt.Errorf("reading CA bundle failed: %v", err)
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in CA bundle " + o.caFile)
+		}
+	}
+	if 0 < len(o.fingerprints) {
+		config.InsecureSkipVerify = true // replaced by the pin check
+	}
+	config.VerifyConnection = func(state tls.ConnectionState) error {
+		return o.verifyConnection(state, logger)
+	}
+	return config, nil
+}
+
+// Log the negotiated connection and check pinned fingerprints.
+func (o tlsOptions) verifyConnection(state tls.ConnectionState, logger *log.Logger) error {
+	if 0 == len(state.PeerCertificates) {
+		return fmt.Errorf("server sent no certificate")
+	}
+	fingerprint := certFingerprint(state.PeerCertificates[0].Raw)
+	logger.Println("TLS " + tls.VersionName(state.Version) + " with " + tls.CipherSuiteName(state.CipherSuite))
+	logger.Println("server certificate " + fingerprint)
+	if 0 == len(o.fingerprints) {
+		return nil
+	}
+	pin := normalizeFingerprint(fingerprint)
+	for _, pinned := range o.fingerprints {
+		if pinned == pin {
+			return nil
+		}
+	}
+	logger.Println("server certificate does not match any tls-fingerprint")
+	return fmt.Errorf("server certificate %s not pinned", fingerprint)
+}
+
+// SHA-256 fingerprint of a DER encoded certificate, as
+// colon separated upper case hex.
+func certFingerprint(der []byte) string {
+	sum := sha256.Sum256(der)
+	hexsum := strings.ToUpper(hex.EncodeToString(sum[:]))
+	pairs := make([]string, 0, len(sum))
+	for i := 0; i < len(hexsum); i += 2 {
+		pairs = append(pairs, hexsum[i:i+2])
+	}
+	return strings.Join(pairs, ":")
+}
+
+// Lower case hex of a fingerprint without separators.
+func normalizeFingerprint(fingerprint string) string {
+	fingerprint = strings.ToLower(strings.TrimSpace(fingerprint))
+	return strings.NewReplacer(":", "", " ", "", "-", "").Replace(fingerprint)
+}
+
+// Configure TLS for the connection (unless it is cleartext).
+func (n *ircNetwork) setupTLS() error {
+	options := n.config.tls
+	if !n.config.useTLS {
+		if options.configured() {
+			n.logger.Println("TLS settings are ignored for cleartext connection")
+		}
+		return nil
+	}
+	config, err := options.tlsConfig(n.logger)
+	if err != nil {
+		return err
+	}
+	n.con.TLSConfig = config
+	return nil
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// self-signed certificate, written as PEM files to a temporary directory
+func createTestCertificate(t *testing.T) (cert *x509.Certificate, certFile, keyFile string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "mress"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	cert, err = x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	dir := t.TempDir()
+	certFile = filepath.Join(dir, "mress.crt")
+	keyFile = filepath.Join(dir, "mress.key")
+	if err = ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err = ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600); err != nil {
+		t.Fatal(err.Error())
+	}
+	return cert, certFile, keyFile
+}
+
+func Test_tlsOptions_tlsConfig_0(t *testing.T) {
+	t.Parallel()
+	logger := createLogger("")
+	config, err := tlsOptions{}.tlsConfig(logger)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if tls.VersionTLS12 != config.MinVersion || 0 != len(config.Certificates) || nil != config.RootCAs || config.InsecureSkipVerify {
+		t.Error("wrong defaults")
+	}
+
+	_, certFile, keyFile := createTestCertificate(t)
+	options := tlsOptions{certFile: certFile, keyFile: keyFile, caFile: certFile, minVersion: "1.3"}
+	config, err = options.tlsConfig(logger)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if tls.VersionTLS13 != config.MinVersion || 1 != len(config.Certificates) || nil == config.RootCAs {
+		t.Error("settings not applied")
+	}
+}
+
+// broken settings are reported before connecting
+func Test_tlsOptions_tlsConfig_1(t *testing.T) {
+	t.Parallel()
+	logger := createLogger("")
+	_, certFile, keyFile := createTestCertificate(t)
+	broken := map[string]tlsOptions{
+		"unknown version":     {minVersion: "2.0"},
+		"missing key":         {certFile: certFile},
+		"missing certificate": {certFile: filepath.Join(t.TempDir(), "missing.crt"), keyFile: keyFile},
+		"missing CA bundle":   {caFile: filepath.Join(t.TempDir(), "missing.pem")},
+		"empty CA bundle":     {caFile: keyFile},
+		"short fingerprint":   {fingerprints: []string{"abcdef"}},
+	}
+	for what, options := range broken {
+		if _, err := options.tlsConfig(logger); err == nil {
+			t.Error(what + " not detected")
+		}
+	}
+}
+
+func Test_tlsOptions_verifyConnection_0(t *testing.T) {
+	t.Parallel()
+	logger := createLogger("")
+	cert, _, _ := createTestCertificate(t)
+	other, _, _ := createTestCertificate(t)
+	state := tls.ConnectionState{Version: tls.VersionTLS13, CipherSuite: tls.TLS_AES_128_GCM_SHA256, PeerCertificates: []*x509.Certificate{cert}}
+	if err := (tlsOptions{}).verifyConnection(state, logger); err != nil {
+		t.Error(err.Error())
+	}
+	pinned := tlsOptions{fingerprints: []string{normalizeFingerprint(certFingerprint(other.Raw)), normalizeFingerprint(certFingerprint(cert.Raw))}}
+	if err := pinned.verifyConnection(state, logger); err != nil {
+		t.Error(err.Error())
+	}
+	pinned.fingerprints = pinned.fingerprints[:1]
+	if err := pinned.verifyConnection(state, logger); err == nil {
+		t.Error("unpinned certificate accepted")
+	}
+	if err := pinned.verifyConnection(tls.ConnectionState{}, logger); err == nil {
+		t.Error("missing certificate accepted")
+	}
+}
+
+func Test_certFingerprint_0(t *testing.T) {
+	t.Parallel()
+	fingerprint := certFingerprint([]byte("mress"))
+	if 32*3-1 != len(fingerprint) || ':' != fingerprint[2] {
+		t.Error("wrong format " + fingerprint)
+	}
+	if normalizeFingerprint(fingerprint) != normalizeFingerprint(" "+fingerprint[:2]+" "+fingerprint[3:]) {
+		t.Error("separators not ignored")
+	}
+}